@@ -12,8 +12,10 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/olekukonko/tablewriter"
+	"github.com/tanelmae/grpc-sample/internal/tlsconfig"
 	"github.com/tanelmae/grpc-sample/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -35,6 +37,11 @@ type cmdFlags struct {
 	secondTo   *string
 	maxRows    *int
 	maxColumns *int
+	caFile     *string
+	certFile   *string
+	keyFile    *string
+	apiKey     *string
+	token      *string
 }
 
 func (cmd cmdFlags) Parse() {
@@ -45,6 +52,45 @@ func (cmd cmdFlags) Print() {
 	cmd.flagSet.PrintDefaults()
 }
 
+// Connects with TLS when CA or client certificate is set
+func (cmd cmdFlags) Dial() (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{}
+
+	callCreds := callCredentials{}
+	if *cmd.apiKey != "" {
+		callCreds["x-api-key"] = *cmd.apiKey
+	}
+	if *cmd.token != "" {
+		callCreds["authorization"] = "Bearer " + *cmd.token
+	}
+	if len(callCreds) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(callCreds))
+	}
+
+	if *cmd.caFile == "" && *cmd.certFile == "" && *cmd.keyFile == "" {
+		opts = append(opts, grpc.WithInsecure())
+		return grpc.Dial(*cmd.serverAddr, opts...)
+	}
+
+	tlsConfig, err := tlsconfig.ClientConfig(*cmd.caFile, *cmd.certFile, *cmd.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	return grpc.Dial(*cmd.serverAddr, opts...)
+}
+
+// Metadata sent with every call
+type callCredentials map[string]string
+
+func (creds callCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return creds, nil
+}
+
+func (creds callCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
 func newCmd(name string) cmdFlags {
 	flagSet := flag.NewFlagSet(name, flag.ExitOnError)
 	return cmdFlags{
@@ -54,6 +100,11 @@ func newCmd(name string) cmdFlags {
 		output:     flagSet.String("out", "", "Format for the command output"),
 		from:       flagSet.String("from", "2019-03-01", "Start time for the period"),
 		to:         flagSet.String("to", "2019-04-01", "End time for the period"),
+		caFile:     flagSet.String("ca", "", "CA certificate for verifying the server. Enables TLS"),
+		certFile:   flagSet.String("cert", "", "Client certificate for mutual TLS"),
+		keyFile:    flagSet.String("key", "", "Client private key for mutual TLS"),
+		apiKey:     flagSet.String("api-key", "", "API key for authentication"),
+		token:      flagSet.String("token", "", "JWT for authentication"),
 	}
 }
 
@@ -106,7 +157,7 @@ func main() {
 			panic(err)
 		}
 
-		conn, err := grpc.Dial(*categoryScoresCmd.serverAddr, grpc.WithInsecure())
+		conn, err := categoryScoresCmd.Dial()
 		if err != nil {
 			panic(err)
 		}
@@ -185,7 +236,7 @@ func main() {
 			panic(err)
 		}
 
-		conn, err := grpc.Dial(*ticketScoresCmd.serverAddr, grpc.WithInsecure())
+		conn, err := ticketScoresCmd.Dial()
 		if err != nil {
 			panic(err)
 		}
@@ -261,7 +312,7 @@ func main() {
 			panic(err)
 		}
 
-		conn, err := grpc.Dial(*overallScoresCmd.serverAddr, grpc.WithInsecure())
+		conn, err := overallScoresCmd.Dial()
 		if err != nil {
 			panic(err)
 		}
@@ -317,7 +368,7 @@ func main() {
 			panic(err)
 		}
 
-		conn, err := grpc.Dial(*diffCmd.serverAddr, grpc.WithInsecure())
+		conn, err := diffCmd.Dial()
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namsral/flag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/config"
+	"github.com/tanelmae/grpc-sample/internal/db/cache"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/internal/ratelimit"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reloadable server parts started with the configuration file and flags like in main
+func newReloadable(t *testing.T, path string, args ...string) *reloadable {
+	t.Helper()
+	cfg := config.Config{}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.BindFlags(flags, &cfg)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	flagConfig := cfg
+	if err := config.Load(&cfg, path, flags); err != nil {
+		t.Fatal(err)
+	}
+
+	logLevel := zap.NewAtomicLevel()
+	if err := logLevel.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		t.Fatal(err)
+	}
+	concurrency, err := ratelimit.ParseConcurrency(cfg.RateLimit.Concurrency.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryCache, err := cache.New(memory.New(), cfg.Cache.Size, cfg.Cache.TTL, cfg.Cache.PastTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &reloadable{
+		log:        zap.NewNop(),
+		configFile: path,
+		flags:      flags,
+		flagConfig: flagConfig,
+		started:    cfg,
+		logLevel:   logLevel,
+		limiter:    ratelimit.New(zap.NewNop(), cfg.RateLimit.Rate, cfg.RateLimit.Burst, concurrency),
+		cache:      queryCache,
+	}
+}
+
+// Number of calls the limiter lets through of the given calls made at once by one client
+func allowedCalls(limiter *ratelimit.Limiter, calls int) int {
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "test"})
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.sample.TicketService/OveralScore"}
+	allowed := 0
+	for i := 0; i < calls; i++ {
+		_, err := limiter.UnaryServerInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		if err == nil {
+			allowed++
+		} else if status.Code(err) != codes.ResourceExhausted {
+			panic(err)
+		}
+	}
+	return allowed
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+log:
+  level: info
+cache:
+  ttl: 1m
+`)
+	r := newReloadable(t, path, "-cache-past-ttl", "2h")
+	if got := allowedCalls(r.limiter, 10); got != 10 {
+		t.Fatalf("got %d calls allowed without rate limits, want 10", got)
+	}
+
+	writeConfig(t, path, `
+log:
+  level: debug
+cache:
+  ttl: 5s
+  past-ttl: 1h
+rate-limit:
+  rate: 1
+  burst: 3
+`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.logLevel.Level() != zapcore.DebugLevel {
+		t.Fatalf("got log level %s, want debug", r.logLevel.Level())
+	}
+	// Flags still take precedence over the file
+	if ttl, pastTTL := r.cache.TTL(); ttl != 5*time.Second || pastTTL != 2*time.Hour {
+		t.Fatalf("got cache TTLs %v and %v, want 5s and 2h", ttl, pastTTL)
+	}
+	if got := allowedCalls(r.limiter, 10); got != 3 {
+		t.Fatalf("got %d calls allowed, want the burst of 3", got)
+	}
+
+	// Invalid file leaves the running configuration in place
+	writeConfig(t, path, `
+log:
+  level: verbose
+cache:
+  ttl: 10s
+`)
+	if err := r.reload(); err == nil {
+		t.Fatal("reload with an invalid log level succeeded")
+	}
+	if r.logLevel.Level() != zapcore.DebugLevel {
+		t.Fatalf("got log level %s after a failed reload, want debug", r.logLevel.Level())
+	}
+	if ttl, _ := r.cache.TTL(); ttl != 5*time.Second {
+		t.Fatalf("got cache TTL %v after a failed reload, want 5s", ttl)
+	}
+}
@@ -0,0 +1,223 @@
+package alert
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+func NewEvaluator(logger *zap.Logger, svcDB db.ServiceDB, store *Store, notifier *Notifier) *Evaluator {
+	return &Evaluator{
+		log:      logger,
+		db:       svcDB,
+		store:    store,
+		notifier: notifier,
+		now:      time.Now,
+		alerts:   map[string]*alertState{},
+	}
+}
+
+/*
+Evaluator checks alert rules against the database on a schedule.
+Notifications are only sent when an alert starts or stops firing,
+so a rule that keeps breaching the threshold notifies each webhook once.
+*/
+type Evaluator struct {
+	log      *zap.Logger
+	db       db.ServiceDB
+	store    *Store
+	notifier *Notifier
+	now      func() time.Time
+
+	// Alerts that have been notified as firing, keyed by rule ID and category
+	alerts map[string]*alertState
+}
+
+type alertState struct {
+	category string
+	// Last evaluated value, sent when the alert resolves without a value
+	value int32
+	// Webhooks that were notified of the firing alert
+	firing map[string]bool
+}
+
+// Evaluates the rules every interval until the context is cancelled
+func (e *Evaluator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.Evaluate(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluates all the rules once
+func (e *Evaluator) Evaluate(ctx context.Context) {
+	now := e.now().UTC()
+	active := map[string]bool{}
+
+	for _, rule := range e.store.List() {
+		from := now.AddDate(0, 0, -int(rule.WindowDays))
+		prefix := rule.Id + "/"
+
+		values, err := e.values(rule, from, now)
+		if err != nil {
+			e.log.Error("alert rule evaluation failed",
+				zap.String("rule", rule.Id),
+				zap.Error(err))
+			// Keep the state until the rule can be evaluated again
+			for key := range e.alerts {
+				if strings.HasPrefix(key, prefix) {
+					active[key] = true
+				}
+			}
+			continue
+		}
+
+		for category, value := range values {
+			key := prefix + category
+			active[key] = true
+			e.notify(ctx, rule, key, category, value, compare(rule.Comparison, value, rule.Threshold), from, now)
+		}
+
+		// Categories without a value, e.g. without ratings in the window or deleted, are resolved
+		for key, state := range e.alerts {
+			if !strings.HasPrefix(key, prefix) || active[key] {
+				continue
+			}
+			if e.notify(ctx, rule, key, state.category, state.value, false, from, now) {
+				active[key] = true
+			}
+		}
+	}
+
+	// Forget the state of deleted rules
+	for key := range e.alerts {
+		if !active[key] {
+			delete(e.alerts, key)
+		}
+	}
+}
+
+/*
+Notifies the rule webhooks whose state differs from breached. State of a webhook only
+changes after a successful delivery, so failed notifications get retried on the next
+evaluation without sending them again to the other webhooks.
+Returns true while some webhook is still notified as firing.
+*/
+func (e *Evaluator) notify(ctx context.Context, rule *pb.AlertRule, key, category string, value int32, breached bool, from, now time.Time) bool {
+	state, ok := e.alerts[key]
+	if !ok {
+		state = &alertState{category: category, firing: map[string]bool{}}
+		e.alerts[key] = state
+	}
+	state.value = value
+
+	payload := Payload{
+		Tenant:     RuleTenant(rule),
+		RuleID:     rule.Id,
+		RuleName:   rule.Name,
+		Status:     StatusResolved,
+		Metric:     rule.Metric.String(),
+		Category:   category,
+		Value:      value,
+		Comparison: rule.Comparison.String(),
+		Threshold:  rule.Threshold,
+		From:       from,
+		To:         now,
+		Time:       now,
+	}
+	if breached {
+		payload.Status = StatusFiring
+	}
+
+	webhooks := map[string]bool{}
+	for _, url := range rule.Webhooks {
+		webhooks[url] = true
+		if state.firing[url] == breached {
+			continue
+		}
+
+		e.log.Info("alert state changed",
+			zap.String("rule", rule.Id),
+			zap.String("category", category),
+			zap.String("webhook", url),
+			zap.String("status", payload.Status),
+			zap.Int32("value", value))
+		if err := e.notifier.Notify(ctx, []string{url}, payload); err != nil {
+			continue
+		}
+		if breached {
+			state.firing[url] = true
+		} else {
+			delete(state.firing, url)
+		}
+	}
+
+	// Webhooks removed from the rule are not notified anymore
+	for url := range state.firing {
+		if !webhooks[url] {
+			delete(state.firing, url)
+		}
+	}
+	return len(state.firing) > 0
+}
+
+/*
+Returns rule values keyed by category name. Overall score uses empty category.
+Windows without ratings have no values, their score would be 0 and fire LESS_THAN rules.
+*/
+func (e *Evaluator) values(rule *pb.AlertRule, from, to time.Time) (map[string]int32, error) {
+	switch rule.Metric {
+	case pb.AlertRule_PERIOD_OVER_PERIOD:
+		// Changes are only returned for the categories rated in both windows
+		prevFrom := from.AddDate(0, 0, -int(rule.WindowDays))
+		diffs, err := e.db.PeriodOverPeriod(RuleTenant(rule), prevFrom, from, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		values := map[string]int32{}
+		for _, diff := range diffs {
+			if rule.Category == "" || rule.Category == diff.Category {
+				values[diff.Category] = diff.Diff
+			}
+		}
+		return values, nil
+	default:
+		counts, err := e.db.RatingCounts(RuleTenant(rule), from, to)
+		if err != nil {
+			return nil, err
+		}
+		var ratings int32
+		for _, count := range counts {
+			ratings += count.Count
+		}
+		if ratings == 0 {
+			return map[string]int32{}, nil
+		}
+
+		score, err := e.db.OveralScore(RuleTenant(rule), from, to)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int32{"": score}, nil
+	}
+}
+
+func compare(comparison pb.AlertRule_Comparison, value, threshold int32) bool {
+	if comparison == pb.AlertRule_GREATER_THAN {
+		return value > threshold
+	}
+	return value < threshold
+}
@@ -0,0 +1,214 @@
+package alert
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Returns the overall score, rating count and category changes set in the test
+type scoreDB struct {
+	*memory.MemoryDB
+
+	mu      sync.Mutex
+	score   int32
+	ratings int32
+	changes []*pb.CategoryDiff
+}
+
+func (s *scoreDB) OveralScore(tenant string, from, to time.Time) (int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.score, nil
+}
+
+func (s *scoreDB) RatingCounts(tenant string, from, to time.Time) ([]*pb.CategoryCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []*pb.CategoryCount{{Id: 1, Name: "Spelling", Count: s.ratings}}, nil
+}
+
+func (s *scoreDB) PeriodOverPeriod(tenant string, firstFrom, firstTo, secondFrom, secondTo time.Time) ([]*pb.CategoryDiff, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changes, nil
+}
+
+func (s *scoreDB) set(score int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.score = score
+}
+
+func (s *scoreDB) setRatings(ratings int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ratings = ratings
+}
+
+func (s *scoreDB) setChanges(changes ...*pb.CategoryDiff) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes = changes
+}
+
+// Overall score rule firing below 80
+func lowScoreRule(hooks ...string) *pb.AlertRule {
+	return &pb.AlertRule{
+		Id:         "low-score",
+		Name:       "Low score",
+		Metric:     pb.AlertRule_OVERALL_SCORE,
+		WindowDays: 7,
+		Comparison: pb.AlertRule_LESS_THAN,
+		Threshold:  80,
+		Webhooks:   hooks,
+	}
+}
+
+func newTestEvaluator(t *testing.T, rule *pb.AlertRule) (*Evaluator, *scoreDB) {
+	t.Helper()
+	store, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Create(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	svcDB := &scoreDB{MemoryDB: memory.New(), score: 90, ratings: 10}
+	e := NewEvaluator(zap.NewNop(), svcDB, store, newTestNotifier())
+	e.now = func() time.Time { return time.Date(2019, 3, 8, 0, 0, 0, 0, time.UTC) }
+	return e, svcDB
+}
+
+func statuses(payloads []Payload) []string {
+	out := []string{}
+	for _, payload := range payloads {
+		out = append(out, payload.Status)
+	}
+	return out
+}
+
+func TestEvaluatorNotifiesTransitions(t *testing.T) {
+	w := newWebhook(t, 0)
+	e, svcDB := newTestEvaluator(t, lowScoreRule(w.URL))
+
+	steps := []struct {
+		score int32
+		want  []string
+	}{
+		{score: 90, want: []string{}},
+		{score: 70, want: []string{StatusFiring}},
+		// Still breaching, notified once
+		{score: 60, want: []string{StatusFiring}},
+		{score: 85, want: []string{StatusFiring, StatusResolved}},
+		{score: 95, want: []string{StatusFiring, StatusResolved}},
+		{score: 79, want: []string{StatusFiring, StatusResolved, StatusFiring}},
+	}
+	for _, step := range steps {
+		svcDB.set(step.score)
+		e.Evaluate(context.Background())
+
+		_, payloads := w.received()
+		if got := statuses(payloads); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("after score %d got notifications %v, want %v", step.score, got, step.want)
+		}
+	}
+
+	_, payloads := w.received()
+	if got := payloads[0]; got.RuleID != "low-score" || got.Value != 70 || got.Threshold != 80 ||
+		got.Tenant != "default" || got.Comparison != "LESS_THAN" || got.Metric != "OVERALL_SCORE" {
+		t.Fatalf("got payload %+v", got)
+	}
+	if got := payloads[1]; got.Value != 85 {
+		t.Fatalf("got resolved value %d, want 85", got.Value)
+	}
+}
+
+func TestEvaluatorRetriesFailedNotification(t *testing.T) {
+	// Fails every attempt of the first evaluation
+	w := newWebhook(t, defaultAttempts)
+	e, svcDB := newTestEvaluator(t, lowScoreRule(w.URL))
+
+	svcDB.set(70)
+	e.Evaluate(context.Background())
+	if _, payloads := w.received(); len(payloads) != 0 {
+		t.Fatalf("got %d deliveries, want none", len(payloads))
+	}
+
+	e.Evaluate(context.Background())
+	if _, payloads := w.received(); len(payloads) != 1 || payloads[0].Status != StatusFiring {
+		t.Fatalf("got notifications %v after the retry, want firing", statuses(payloads))
+	}
+}
+
+func TestEvaluatorRetriesOnlyFailedWebhooks(t *testing.T) {
+	working, failing := newWebhook(t, 0), newWebhook(t, defaultAttempts)
+	e, svcDB := newTestEvaluator(t, lowScoreRule(working.URL, failing.URL))
+
+	svcDB.set(70)
+	e.Evaluate(context.Background())
+	e.Evaluate(context.Background())
+
+	if _, payloads := working.received(); !reflect.DeepEqual(statuses(payloads), []string{StatusFiring}) {
+		t.Fatalf("got notifications %v to the working webhook, want one firing", statuses(payloads))
+	}
+	if _, payloads := failing.received(); !reflect.DeepEqual(statuses(payloads), []string{StatusFiring}) {
+		t.Fatalf("got notifications %v to the failing webhook after the retry, want one firing", statuses(payloads))
+	}
+}
+
+func TestEvaluatorSkipsWindowsWithoutRatings(t *testing.T) {
+	w := newWebhook(t, 0)
+	e, svcDB := newTestEvaluator(t, lowScoreRule(w.URL))
+
+	svcDB.set(0)
+	svcDB.setRatings(0)
+	e.Evaluate(context.Background())
+	if _, payloads := w.received(); len(payloads) != 0 {
+		t.Fatalf("got notifications %v for an empty window, want none", statuses(payloads))
+	}
+
+	// Firing alert resolves when the window runs out of ratings
+	svcDB.set(70)
+	svcDB.setRatings(10)
+	e.Evaluate(context.Background())
+	svcDB.setRatings(0)
+	e.Evaluate(context.Background())
+	if _, payloads := w.received(); !reflect.DeepEqual(statuses(payloads), []string{StatusFiring, StatusResolved}) {
+		t.Fatalf("got notifications %v, want firing and resolved", statuses(payloads))
+	}
+}
+
+func TestEvaluatorResolvesRemovedCategories(t *testing.T) {
+	w := newWebhook(t, 0)
+	e, svcDB := newTestEvaluator(t, &pb.AlertRule{
+		Id:         "drop",
+		Name:       "Drop",
+		Metric:     pb.AlertRule_PERIOD_OVER_PERIOD,
+		WindowDays: 7,
+		Comparison: pb.AlertRule_LESS_THAN,
+		Threshold:  -5,
+		Webhooks:   []string{w.URL},
+	})
+
+	svcDB.setChanges(&pb.CategoryDiff{Id: 1, Category: "Spelling", Diff: -10}, &pb.CategoryDiff{Id: 2, Category: "Grammar", Diff: 2})
+	e.Evaluate(context.Background())
+	svcDB.setChanges(&pb.CategoryDiff{Id: 2, Category: "Grammar", Diff: 1})
+	e.Evaluate(context.Background())
+
+	_, payloads := w.received()
+	if !reflect.DeepEqual(statuses(payloads), []string{StatusFiring, StatusResolved}) {
+		t.Fatalf("got notifications %v, want firing and resolved", statuses(payloads))
+	}
+	if got := payloads[1]; got.Category != "Spelling" || got.Value != -10 {
+		t.Fatalf("got resolved payload %+v, want Spelling with the last value", got)
+	}
+}
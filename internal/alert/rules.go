@@ -0,0 +1,222 @@
+package alert
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+var (
+	ErrNotFound    = errors.New("alert rule not found")
+	ErrInvalidRule = errors.New("invalid alert rule")
+)
+
+/*
+Rule store keeps alert rules in memory.
+When a file path is set rules are loaded from it and every change is written back to it.
+*/
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path:  path,
+		rules: map[string]*pb.AlertRule{},
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	rules, err := LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		store.rules[rule.Id] = rule
+	}
+	return store, nil
+}
+
+type Store struct {
+	path  string
+	mu    sync.RWMutex
+	rules map[string]*pb.AlertRule
+}
+
+// Returns rules sorted by ID
+func (store *Store) List() []*pb.AlertRule {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	rules := make([]*pb.AlertRule, 0, len(store.rules))
+	for _, rule := range store.rules {
+		rules = append(rules, proto.Clone(rule).(*pb.AlertRule))
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	return rules
+}
+
+func (store *Store) Get(id string) (*pb.AlertRule, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	rule, ok := store.rules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(rule).(*pb.AlertRule), nil
+}
+
+func (store *Store) Create(rule *pb.AlertRule) (*pb.AlertRule, error) {
+	if err := ValidateRule(rule); err != nil {
+		return nil, err
+	}
+
+	rule = proto.Clone(rule).(*pb.AlertRule)
+	if rule.Id == "" {
+		rule.Id = newID()
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.rules[rule.Id]; ok {
+		return nil, errors.Wrapf(ErrInvalidRule, "rule %s already exists", rule.Id)
+	}
+	store.rules[rule.Id] = rule
+	return rule, store.save()
+}
+
+func (store *Store) Update(rule *pb.AlertRule) (*pb.AlertRule, error) {
+	if err := ValidateRule(rule); err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.rules[rule.Id]; !ok {
+		return nil, ErrNotFound
+	}
+	rule = proto.Clone(rule).(*pb.AlertRule)
+	store.rules[rule.Id] = rule
+	return rule, store.save()
+}
+
+func (store *Store) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.rules[id]; !ok {
+		return ErrNotFound
+	}
+	delete(store.rules, id)
+	return store.save()
+}
+
+// Replaces all the rules, e.g. with the ones read again from the store file with LoadRules
+func (store *Store) Replace(rules []*pb.AlertRule) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.rules = map[string]*pb.AlertRule{}
+	for _, rule := range rules {
+		store.rules[rule.Id] = proto.Clone(rule).(*pb.AlertRule)
+	}
+}
+
+// Writes rules to the store file. Caller must hold the lock.
+func (store *Store) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	out := &pb.AlertRules{Rules: make([]*pb.AlertRule, 0, len(store.rules))}
+	for _, rule := range store.rules {
+		out.Rules = append(out.Rules, rule)
+	}
+	sort.Slice(out.Rules, func(i, j int) bool { return out.Rules[i].Id < out.Rules[j].Id })
+
+	b, err := protojson.MarshalOptions{Indent: "  ", UseProtoNames: true}.Marshal(out)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode alert rules")
+	}
+
+	// Write to a temporary file first so a failed write does not corrupt the rules
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write alert rules")
+	}
+	return errors.Wrap(os.Rename(tmp, store.path), "failed to write alert rules")
+}
+
+// Reads and validates rules from a JSON file. Missing file is treated as empty rule set.
+func LoadRules(path string) ([]*pb.AlertRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read alert rules")
+	}
+
+	rules := &pb.AlertRules{}
+	if err := protojson.Unmarshal(b, rules); err != nil {
+		return nil, errors.Wrap(err, "failed to parse alert rules")
+	}
+
+	seen := map[string]bool{}
+	for _, rule := range rules.Rules {
+		if rule.Id == "" {
+			return nil, errors.Wrapf(ErrInvalidRule, "rule %q has no ID", rule.Name)
+		}
+		if seen[rule.Id] {
+			return nil, errors.Wrapf(ErrInvalidRule, "duplicate rule ID %s", rule.Id)
+		}
+		seen[rule.Id] = true
+		if err := ValidateRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return rules.Rules, nil
+}
+
+func ValidateRule(rule *pb.AlertRule) error {
+	if rule.Name == "" {
+		return errors.Wrap(ErrInvalidRule, "name is required")
+	}
+	if rule.WindowDays <= 0 {
+		return errors.Wrap(ErrInvalidRule, "window_days must be positive")
+	}
+	if _, ok := pb.AlertRule_Metric_name[int32(rule.Metric)]; !ok {
+		return errors.Wrap(ErrInvalidRule, "unknown metric")
+	}
+	if _, ok := pb.AlertRule_Comparison_name[int32(rule.Comparison)]; !ok {
+		return errors.Wrap(ErrInvalidRule, "unknown comparison")
+	}
+	if len(rule.Webhooks) == 0 {
+		return errors.Wrap(ErrInvalidRule, "at least one webhook is required")
+	}
+	for _, hook := range rule.Webhooks {
+		// Addresses are checked when connecting, since host names can resolve to anything
+		u, err := url.Parse(hook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+			return errors.Wrapf(ErrInvalidRule, "invalid webhook URL %q", hook)
+		}
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,119 @@
+package alert
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+func NewServer(logger *zap.Logger, store *Store) *Server {
+	return &Server{
+		log:   logger,
+		store: store,
+	}
+}
+
+/*
+Implements pb.AlertServiceServer on top of the rule store.
+Callers only see and change the rules of their own tenant.
+*/
+type Server struct {
+	log   *zap.Logger
+	store *Store
+}
+
+func (s *Server) CreateRule(ctx context.Context, in *pb.AlertRule) (*pb.AlertRule, error) {
+	tenant := auth.Tenant(ctx)
+	s.log.Info("create alert rule",
+		zap.String("tenant", tenant),
+		zap.String("name", in.Name))
+
+	in.Tenant = tenant
+	rule, err := s.store.Create(in)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	return rule, nil
+}
+
+func (s *Server) UpdateRule(ctx context.Context, in *pb.AlertRule) (*pb.AlertRule, error) {
+	tenant := auth.Tenant(ctx)
+	s.log.Info("update alert rule",
+		zap.String("tenant", tenant),
+		zap.String("id", in.Id))
+
+	if err := s.checkTenant(tenant, in.Id); err != nil {
+		return nil, err
+	}
+	in.Tenant = tenant
+	rule, err := s.store.Update(in)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	return rule, nil
+}
+
+func (s *Server) DeleteRule(ctx context.Context, in *pb.AlertRuleID) (*emptypb.Empty, error) {
+	tenant := auth.Tenant(ctx)
+	s.log.Info("delete alert rule",
+		zap.String("tenant", tenant),
+		zap.String("id", in.Id))
+
+	if err := s.checkTenant(tenant, in.Id); err != nil {
+		return nil, err
+	}
+	if err := s.store.Delete(in.Id); err != nil {
+		return nil, s.statusError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListRules(ctx context.Context, in *emptypb.Empty) (*pb.AlertRules, error) {
+	tenant := auth.Tenant(ctx)
+	out := &pb.AlertRules{Rules: []*pb.AlertRule{}}
+	for _, rule := range s.store.List() {
+		if RuleTenant(rule) == tenant {
+			out.Rules = append(out.Rules, rule)
+		}
+	}
+	return out, nil
+}
+
+// Rules of other tenants are reported as not found
+func (s *Server) checkTenant(tenant, id string) error {
+	rule, err := s.store.Get(id)
+	if err != nil {
+		return s.statusError(err)
+	}
+	if RuleTenant(rule) != tenant {
+		return s.statusError(ErrNotFound)
+	}
+	return nil
+}
+
+// Rules created before tenants were introduced belong to the default tenant
+func RuleTenant(rule *pb.AlertRule) string {
+	if rule.Tenant == "" {
+		return auth.DefaultTenant
+	}
+	return rule.Tenant
+}
+
+func (s *Server) statusError(err error) error {
+	switch errors.Cause(err) {
+	case ErrInvalidRule:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		s.log.Error("alert store error", zap.Error(err))
+		return status.Error(codes.Internal, "failed to store alert rules")
+	}
+}
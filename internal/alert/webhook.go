@@ -0,0 +1,156 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+
+	defaultAttempts = 3
+	defaultBackoff  = time.Second
+	defaultTimeout  = 10 * time.Second
+)
+
+// JSON body posted to the webhook URLs
+type Payload struct {
+	Tenant     string    `json:"tenant"`
+	RuleID     string    `json:"rule_id"`
+	RuleName   string    `json:"rule_name"`
+	Status     string    `json:"status"`
+	Metric     string    `json:"metric"`
+	Category   string    `json:"category,omitempty"`
+	Value      int32     `json:"value"`
+	Comparison string    `json:"comparison"`
+	Threshold  int32     `json:"threshold"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Time       time.Time `json:"time"`
+}
+
+// Rule webhooks are set by API callers, so they can not reach internal addresses unless allowed
+func NewNotifier(logger *zap.Logger, allowPrivate bool) *Notifier {
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+	if !allowPrivate {
+		dialer.Control = publicOnly
+	}
+	return &Notifier{
+		log: logger,
+		client: &http.Client{
+			Timeout: defaultTimeout,
+			// Without a proxy every connection, also after redirects, is checked by the dialer
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: defaultTimeout,
+			},
+		},
+		attempts: defaultAttempts,
+		backoff:  defaultBackoff,
+	}
+}
+
+// Refuses connections to loopback, private, link-local and other non-public addresses
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid webhook address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return errors.Errorf("webhook address %s is not public", ip)
+	}
+	return nil
+}
+
+/*
+Webhook notifier posts alert payloads as JSON.
+Failed deliveries are retried with exponential backoff.
+*/
+type Notifier struct {
+	log      *zap.Logger
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+// Delivers the payload to every URL. Returns the first delivery error.
+func (n *Notifier) Notify(ctx context.Context, urls []string, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode alert payload")
+	}
+
+	var firstErr error
+	for _, url := range urls {
+		if err := n.deliver(ctx, url, body); err != nil {
+			n.log.Error("webhook delivery failed",
+				zap.String("rule", payload.RuleID),
+				zap.String("url", url),
+				zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (n *Notifier) deliver(ctx context.Context, url string, body []byte) error {
+	backoff := n.backoff
+	var err error
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		if err = n.post(ctx, url, body); err == nil {
+			return nil
+		}
+		if attempt == n.attempts {
+			break
+		}
+
+		n.log.Warn("webhook delivery attempt failed",
+			zap.String("url", url),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return errors.Wrapf(err, "giving up after %d attempts", n.attempts)
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+/*
+API keys file format:
+
+	{
+	  "keys": [
+	    {"key": "secret", "subject": "dashboard", "roles": ["analyst"], "tenant": "acme"}
+	  ]
+	}
+*/
+type apiKeysFile struct {
+	Keys []struct {
+		Key     string   `json:"key"`
+		Subject string   `json:"subject"`
+		Roles   []string `json:"roles"`
+		Tenant  string   `json:"tenant"`
+	} `json:"keys"`
+}
+
+// Static API keys loaded from a file
+type APIKeys struct {
+	// Principals by SHA-256 of the key
+	keys map[[sha256.Size]byte]*Principal
+}
+
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read API keys")
+	}
+
+	file := apiKeysFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse API keys")
+	}
+
+	keys := &APIKeys{keys: map[[sha256.Size]byte]*Principal{}}
+	for i, entry := range file.Keys {
+		if entry.Key == "" || entry.Subject == "" {
+			return nil, errors.Errorf("API key %d: key and subject are required", i)
+		}
+		if entry.Tenant != "" {
+			if err := ValidateTenant(entry.Tenant); err != nil {
+				return nil, errors.Wrapf(err, "API key %d", i)
+			}
+		}
+		hash := sha256.Sum256([]byte(entry.Key))
+		if _, ok := keys.keys[hash]; ok {
+			return nil, errors.Errorf("API key %d: duplicate key", i)
+		}
+		keys.keys[hash] = &Principal{
+			Subject: entry.Subject,
+			Roles:   entry.Roles,
+			Method:  MethodAPIKey,
+			Tenant:  entry.Tenant,
+		}
+	}
+	return keys, nil
+}
+
+func (keys *APIKeys) Lookup(key string) (*Principal, error) {
+	// Keys are looked up by hash so lookup time does not depend on the key contents
+	principal, ok := keys.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("unknown API key")
+	}
+	return principal, nil
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	MethodAPIKey = "api-key"
+	MethodJWT    = "jwt"
+
+	// Tenant of unauthenticated callers and principals without a tenant
+	DefaultTenant = "default"
+
+	apiKeyHeader        = "x-api-key"
+	authorizationHeader = "authorization"
+	bearerPrefix        = "bearer "
+)
+
+// Methods with these prefixes do not require authentication
+var exemptPrefixes = []string{
+	"/grpc.health.v1.Health/",
+}
+
+var (
+	errNoCredentials = errors.New("missing credentials")
+
+	// Tenant IDs are used in file paths so only safe characters are allowed
+	tenantID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// Authenticated caller
+type Principal struct {
+	Subject string
+	Roles   []string
+	// How the caller was authenticated, MethodAPIKey or MethodJWT
+	Method string
+	// Tenant whose data the caller can access, DefaultTenant when not set
+	Tenant string
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// Returns the tenant of the caller. Calls without a tenant belong to DefaultTenant.
+func Tenant(ctx context.Context) string {
+	if principal, ok := FromContext(ctx); ok && principal.Tenant != "" {
+		return principal.Tenant
+	}
+	return DefaultTenant
+}
+
+func ValidateTenant(tenant string) error {
+	if !tenantID.MatchString(tenant) {
+		return errors.Errorf("invalid tenant ID %q", tenant)
+	}
+	return nil
+}
+
+/*
+Authenticator checks call credentials against static API keys and JWTs.
+API keys are passed in "x-api-key" metadata and JWTs as "authorization: Bearer <token>".
+Either of them can be left nil to disable that method.
+*/
+func NewAuthenticator(logger *zap.Logger, keys *APIKeys, jwks *JWTVerifier) *Authenticator {
+	return &Authenticator{
+		log:  logger,
+		keys: keys,
+		jwks: jwks,
+	}
+}
+
+type Authenticator struct {
+	log *zap.Logger
+
+	mu   sync.RWMutex
+	keys *APIKeys
+	jwks *JWTVerifier
+}
+
+// Replaces the credentials while the service is running. Either of them can be nil to disable that method.
+func (a *Authenticator) SetCredentials(keys *APIKeys, jwks *JWTVerifier) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.jwks = jwks
+}
+
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+/*
+Authenticates plain HTTP requests with the same credentials as gRPC calls.
+API key is read from "X-Api-Key" header and JWT from "Authorization" header.
+*/
+func (a *Authenticator) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		md := metadata.MD{}
+		if value := req.Header.Get(apiKeyHeader); value != "" {
+			md.Set(apiKeyHeader, value)
+		}
+		if value := req.Header.Get(authorizationHeader); value != "" {
+			md.Set(authorizationHeader, value)
+		}
+
+		ctx, err := a.authenticate(metadata.NewIncomingContext(req.Context(), md), req.URL.Path)
+		if err != nil {
+			http.Error(res, "invalid or missing credentials", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// Returns context with the authenticated principal
+func (a *Authenticator) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	if Exempt(fullMethod) {
+		return ctx, nil
+	}
+
+	principal, err := a.principal(ctx)
+	if err != nil {
+		a.log.Info("authentication failed",
+			zap.String("method", fullMethod),
+			zap.Error(err))
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing credentials")
+	}
+	return NewContext(ctx, principal), nil
+}
+
+func (a *Authenticator) principal(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	a.mu.RLock()
+	keys, jwks := a.keys, a.jwks
+	a.mu.RUnlock()
+
+	if values := md.Get(apiKeyHeader); len(values) > 0 && keys != nil {
+		return keys.Lookup(values[0])
+	}
+
+	if values := md.Get(authorizationHeader); len(values) > 0 && jwks != nil {
+		value := values[0]
+		if len(value) < len(bearerPrefix) || !strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+		return jwks.Verify(strings.TrimSpace(value[len(bearerPrefix):]))
+	}
+
+	return nil, errNoCredentials
+}
+
+// Reports whether the method is served without authentication, e.g. health checks
+func Exempt(fullMethod string) bool {
+	for _, prefix := range exemptPrefixes {
+		if strings.HasPrefix(fullMethod, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server stream with the authenticated context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+// JSON Web Key Set as defined in RFC 7517. Only public RSA and EC keys are supported.
+type jwksFile struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+/*
+JWTVerifier validates JWT signatures against keys from a local JWKS file.
+Tokens must have the "kid" header matching a key, a valid "exp" claim and
+the issuer and audience when those are set. Roles are read from the "roles" claim
+and tenant from the "tenant" claim.
+*/
+type JWTVerifier struct {
+	keys     map[string]interface{}
+	issuer   string
+	audience string
+}
+
+func LoadJWKS(path, issuer, audience string) (*JWTVerifier, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read JWKS")
+	}
+
+	file := jwksFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JWKS")
+	}
+
+	verifier := &JWTVerifier{
+		keys:     map[string]interface{}{},
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	for i, key := range file.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.Kid == "" {
+			return nil, errors.Errorf("JWKS key %d has no kid", i)
+		}
+
+		var publicKey interface{}
+		switch key.Kty {
+		case "RSA":
+			publicKey, err = rsaKey(key.N, key.E)
+		case "EC":
+			publicKey, err = ecKey(key.Crv, key.X, key.Y)
+		default:
+			err = errors.Errorf("unsupported key type %q", key.Kty)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "JWKS key %s", key.Kid)
+		}
+		verifier.keys[key.Kid] = publicKey
+	}
+
+	if len(verifier.keys) == 0 {
+		return nil, errors.New("no signing keys found in JWKS")
+	}
+	return verifier, nil
+}
+
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := v.keys[kid]
+		if !ok {
+			return nil, errors.Errorf("unknown key ID %q", kid)
+		}
+
+		// Signing method must match the key type so a public key can't be used as HMAC secret
+		switch key.(type) {
+		case *rsa.PublicKey:
+			switch t.Method.(type) {
+			case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			default:
+				return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := t.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+			}
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if v.audience != "" && !claims.Audience.contains(v.audience) {
+		return nil, errors.New("invalid token audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	if claims.Tenant != "" {
+		if err := ValidateTenant(claims.Tenant); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Principal{
+		Subject: claims.Subject,
+		Roles:   claims.Roles,
+		Method:  MethodJWT,
+		Tenant:  claims.Tenant,
+	}, nil
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Roles     []string `json:"roles"`
+	Tenant    string   `json:"tenant"`
+}
+
+func (c *tokenClaims) Valid() error {
+	now := time.Now().Unix()
+	if c.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if now > c.ExpiresAt {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != 0 && now < c.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// Audience claim can be a single string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, item := range a {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid modulus")
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid exponent")
+	}
+
+	exponent := new(big.Int).SetBytes(eBytes)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+func ecKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("unsupported curve %q", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid x coordinate")
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid y coordinate")
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return key, nil
+}
@@ -0,0 +1,517 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+/*
+Authorization policy file format:
+
+	roles:
+	  analyst:
+	    methods:
+	      - /grpc.sample.TicketService/*
+	    # Optional, all categories are visible when not set
+	    categories: [Spelling, Grammar]
+	  admin:
+	    methods:
+	      - "*"
+
+Methods are full gRPC method names from service.proto. "/package.Service/*" allows
+all the methods of a service and "*" allows everything.
+*/
+type policyFile struct {
+	Roles map[string]struct {
+		Methods    []string `yaml:"methods"`
+		Categories []string `yaml:"categories"`
+	} `yaml:"roles"`
+}
+
+type role struct {
+	methods []string
+	// Visible categories, nil when not restricted
+	categories map[string]bool
+}
+
+// Policy maps caller roles to the methods and categories they are allowed to access
+type Policy struct {
+	audit *zap.Logger
+	roles map[string]role
+
+	categoryName func(tenant string, id int32) (string, bool, error)
+	ruleCategory func(tenant, id string) (string, bool, error)
+}
+
+type PolicyOption func(*Policy)
+
+/*
+Resolves rating category IDs of the caller's tenant to names, so that restricted callers
+can only add ratings of their categories. Ratings are denied to them without it or when it fails.
+*/
+func WithCategoryLookup(lookup func(tenant string, id int32) (name string, found bool, err error)) PolicyOption {
+	return func(p *Policy) {
+		p.categoryName = lookup
+	}
+}
+
+/*
+Resolves alert rule IDs of the caller's tenant to the rule category, so that restricted callers
+can only change rules of their categories. Changes by ID are denied to them without it or when it fails.
+*/
+func WithRuleLookup(lookup func(tenant, id string) (category string, found bool, err error)) PolicyOption {
+	return func(p *Policy) {
+		p.ruleCategory = lookup
+	}
+}
+
+/*
+Loads and validates the policy file. Denied calls are logged to the audit logger.
+Every method in the policy must exist in the registered protobuf services.
+*/
+func LoadPolicy(audit *zap.Logger, path string, opts ...PolicyOption) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read policy")
+	}
+
+	file := policyFile{}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse policy")
+	}
+
+	policy := &Policy{
+		audit: audit,
+		roles: map[string]role{},
+	}
+	for name, entry := range file.Roles {
+		for _, method := range entry.Methods {
+			if err := validateMethod(method); err != nil {
+				return nil, errors.Wrapf(err, "role %s", name)
+			}
+		}
+
+		r := role{methods: entry.Methods}
+		if len(entry.Categories) > 0 {
+			r.categories = map[string]bool{}
+			for _, category := range entry.Categories {
+				r.categories[category] = true
+			}
+		}
+		policy.roles[name] = r
+	}
+	for _, opt := range opts {
+		opt(policy)
+	}
+	return policy, nil
+}
+
+func validateMethod(method string) error {
+	if method == "*" {
+		return nil
+	}
+
+	parts := strings.Split(method, "/")
+	if len(parts) != 3 || parts[0] != "" {
+		return errors.Errorf("invalid method %q, expected /package.Service/Method", method)
+	}
+
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(parts[1]))
+	if err != nil {
+		return errors.Errorf("unknown service in %q", method)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return errors.Errorf("unknown service in %q", method)
+	}
+	if parts[2] != "*" && service.Methods().ByName(protoreflect.Name(parts[2])) == nil {
+		return errors.Errorf("unknown method %q", method)
+	}
+	return nil
+}
+
+func matchMethod(pattern, fullMethod string) bool {
+	if pattern == "*" || pattern == fullMethod {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(fullMethod, strings.TrimSuffix(pattern, "*"))
+}
+
+/*
+Returns whether the principal may call the method and which categories it may see.
+Nil categories means no restriction. Roles are combined, so a role without
+category restrictions lifts the restrictions of the other roles.
+*/
+func (p *Policy) authorize(principal *Principal, fullMethod string) (bool, map[string]bool) {
+	allowed := false
+	var categories map[string]bool
+	unrestricted := false
+
+	for _, name := range principal.Roles {
+		r, ok := p.roles[name]
+		if !ok {
+			continue
+		}
+
+		matched := false
+		for _, pattern := range r.methods {
+			if matchMethod(pattern, fullMethod) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		allowed = true
+		if r.categories == nil {
+			unrestricted = true
+			continue
+		}
+		if categories == nil {
+			categories = map[string]bool{}
+		}
+		for category := range r.categories {
+			categories[category] = true
+		}
+	}
+
+	if unrestricted {
+		return allowed, nil
+	}
+	return allowed, categories
+}
+
+func (p *Policy) check(ctx context.Context, fullMethod string) (map[string]bool, error) {
+	principal, ok := FromContext(ctx)
+	if !ok {
+		p.audit.Warn("access denied",
+			zap.String("method", fullMethod),
+			zap.String("reason", "not authenticated"))
+		return nil, status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	allowed, categories := p.authorize(principal, fullMethod)
+	if !allowed {
+		p.audit.Warn("access denied",
+			zap.String("method", fullMethod),
+			zap.String("subject", principal.Subject),
+			zap.Strings("roles", principal.Roles),
+			zap.String("reason", "no role allows the method"))
+		return nil, status.Error(codes.PermissionDenied, "access denied")
+	}
+	return categories, nil
+}
+
+// Must be chained after the authentication interceptor
+func (p *Policy) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if Exempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		categories, err := p.check(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if categories != nil {
+			// Writes are checked before they are made, responses only filter what is read
+			if err := p.checkRequest(ctx, info.FullMethod, req, categories); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil || categories == nil {
+			return resp, err
+		}
+		return filterCategories(resp, categories)
+	}
+}
+
+// Must be chained after the authentication interceptor
+func (p *Policy) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if Exempt(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		categories, err := p.check(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if categories == nil {
+			return handler(srv, ss)
+		}
+		return handler(srv, &filteredStream{ServerStream: ss, categories: categories})
+	}
+}
+
+// Filters every streamed response like the unary ones
+type filteredStream struct {
+	grpc.ServerStream
+	categories map[string]bool
+}
+
+func (s *filteredStream) SendMsg(m interface{}) error {
+	filtered, err := filterCategories(m, s.categories)
+	if err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(filtered)
+}
+
+type categoriesKey struct{}
+
+/*
+Categories the caller of an HTTP endpoint may see, set by Policy.HTTPHandler.
+Returns false when the caller is not restricted to some categories.
+*/
+func AllowedCategories(ctx context.Context) (map[string]bool, bool) {
+	categories, ok := ctx.Value(categoriesKey{}).(map[string]bool)
+	return categories, ok
+}
+
+/*
+Authorizes plain HTTP requests as calls of the gRPC methods that serve the same data.
+methods returns the methods of the request and all of them must be allowed, requests without
+methods are denied. Handlers must filter the data with AllowedCategories.
+Must be wrapped in the authentication handler.
+*/
+func (p *Policy) HTTPHandler(methods func(req *http.Request) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		required := methods(req)
+		if len(required) == 0 {
+			p.audit.Warn("access denied",
+				zap.String("path", req.URL.Path),
+				zap.String("reason", "no method serves the path"))
+			http.Error(res, "access denied", http.StatusForbidden)
+			return
+		}
+
+		var allowed map[string]bool
+		for _, method := range required {
+			categories, err := p.check(req.Context(), method)
+			if err != nil {
+				http.Error(res, "access denied", http.StatusForbidden)
+				return
+			}
+			allowed = intersect(allowed, categories)
+		}
+
+		ctx := req.Context()
+		if allowed != nil {
+			ctx = context.WithValue(ctx, categoriesKey{}, allowed)
+		}
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// Categories visible in both, nil stands for all the categories
+func intersect(a, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	out := map[string]bool{}
+	for category := range a {
+		if b[category] {
+			out[category] = true
+		}
+	}
+	return out
+}
+
+/*
+Denies requests of restricted callers that refer to other categories. Alert rules without
+a category cover all of them, so they are denied too. IDs the lookups do not find are left
+for the handler to reject. Unknown request types are denied.
+*/
+func (p *Policy) checkRequest(ctx context.Context, fullMethod string, req interface{}, allowed map[string]bool) error {
+	tenant := Tenant(ctx)
+	var categories []string
+	switch in := req.(type) {
+	case *pb.TimePeriod, *pb.TimePeriods, *emptypb.Empty:
+		return nil
+	case *pb.Category:
+		categories = []string{in.Name}
+	case *pb.AlertRule:
+		categories = []string{in.Category}
+		if in.Id != "" {
+			category, err := p.lookupRule(tenant, in.Id)
+			if err != nil {
+				return p.denyRequest(ctx, fullMethod, err.Error())
+			}
+			categories = append(categories, category...)
+		}
+	case *pb.AlertRuleID:
+		category, err := p.lookupRule(tenant, in.Id)
+		if err != nil {
+			return p.denyRequest(ctx, fullMethod, err.Error())
+		}
+		categories = category
+	case *pb.Ticket:
+		names, err := p.lookupRatings(tenant, in.Ratings)
+		if err != nil {
+			return p.denyRequest(ctx, fullMethod, err.Error())
+		}
+		categories = names
+	case *pb.TicketRatings:
+		names, err := p.lookupRatings(tenant, in.Ratings)
+		if err != nil {
+			return p.denyRequest(ctx, fullMethod, err.Error())
+		}
+		categories = names
+	default:
+		return p.denyRequest(ctx, fullMethod, "request is not supported with category restrictions")
+	}
+
+	for _, category := range categories {
+		if !allowed[category] {
+			return p.denyRequest(ctx, fullMethod, "category is not allowed")
+		}
+	}
+	return nil
+}
+
+// Category of the rule, none when the rule does not exist
+func (p *Policy) lookupRule(tenant, id string) ([]string, error) {
+	if p.ruleCategory == nil {
+		return nil, errors.New("alert rules can not be resolved")
+	}
+	category, found, err := p.ruleCategory(tenant, id)
+	if err != nil || !found {
+		return nil, err
+	}
+	return []string{category}, nil
+}
+
+// Categories of the ratings that exist
+func (p *Policy) lookupRatings(tenant string, ratings []*pb.Rating) ([]string, error) {
+	if len(ratings) == 0 {
+		return nil, nil
+	}
+	if p.categoryName == nil {
+		return nil, errors.New("rating categories can not be resolved")
+	}
+	names := []string{}
+	for _, rating := range ratings {
+		name, found, err := p.categoryName(tenant, rating.CategoryId)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (p *Policy) denyRequest(ctx context.Context, fullMethod, reason string) error {
+	principal, _ := FromContext(ctx)
+	p.audit.Warn("access denied",
+		zap.String("method", fullMethod),
+		zap.String("subject", principal.Subject),
+		zap.Strings("roles", principal.Roles),
+		zap.String("reason", reason))
+	return status.Error(codes.PermissionDenied, "access denied")
+}
+
+/*
+Removes data of the categories the caller is not allowed to see.
+Overall score is calculated over all the categories so it is not available to restricted callers.
+*/
+func filterCategories(resp interface{}, allowed map[string]bool) (interface{}, error) {
+	switch out := resp.(type) {
+	case *pb.OveralScoreOut:
+		return nil, status.Error(codes.PermissionDenied, "overall score is not available with category restrictions")
+	case *pb.CategoryScoresOut:
+		scores := out.Scores[:0]
+		for _, score := range out.Scores {
+			if allowed[score.Category] {
+				scores = append(scores, score)
+			}
+		}
+		out.Scores = scores
+
+		counts := out.Counts[:0]
+		for _, count := range out.Counts {
+			if allowed[count.Name] {
+				counts = append(counts, count)
+			}
+		}
+		out.Counts = counts
+	case *pb.TicketScoresOut:
+		scores := out.Scores[:0]
+		for _, score := range out.Scores {
+			if allowed[score.Category] {
+				scores = append(scores, score)
+			}
+		}
+		out.Scores = scores
+
+		categories := out.Categories[:0]
+		for _, category := range out.Categories {
+			if allowed[category] {
+				categories = append(categories, category)
+			}
+		}
+		out.Categories = categories
+	case *pb.PeriodOverPeriodOut:
+		changes := out.Changes[:0]
+		for _, change := range out.Changes {
+			if allowed[change.Category] {
+				changes = append(changes, change)
+			}
+		}
+		out.Changes = changes
+	case *pb.Categories:
+		categories := out.Categories[:0]
+		for _, category := range out.Categories {
+			if allowed[category.Name] {
+				categories = append(categories, category)
+			}
+		}
+		out.Categories = categories
+	case *pb.Category:
+		if !allowed[out.Name] {
+			return nil, status.Error(codes.PermissionDenied, "category is not available")
+		}
+	case *pb.AlertRules:
+		// Rules without a category are evaluated over all of them
+		rules := out.Rules[:0]
+		for _, rule := range out.Rules {
+			if rule.Category != "" && allowed[rule.Category] {
+				rules = append(rules, rule)
+			}
+		}
+		out.Rules = rules
+	case *pb.AlertRule:
+		if !allowed[out.Category] {
+			return nil, status.Error(codes.PermissionDenied, "alert rule is not available with category restrictions")
+		}
+	case *pb.Ticket:
+		// Ratings were checked in the request
+	case *emptypb.Empty:
+	default:
+		return nil, status.Error(codes.PermissionDenied, "response is not available with category restrictions")
+	}
+	return resp, nil
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const testPolicy = `
+roles:
+  analyst:
+    methods:
+      - /grpc.sample.TicketService/*
+    categories: [Spelling]
+  viewer:
+    methods:
+      - /grpc.sample.TicketService/TicketScores
+  editor:
+    methods:
+      - "*"
+    categories: [Spelling]
+`
+
+// Category 1 is Spelling and 2 Grammar, rules are named after their categories
+func loadTestPolicy(t *testing.T) *Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	categories := map[int32]string{1: "Spelling", 2: "Grammar"}
+	rules := map[string]string{"spelling": "Spelling", "grammar": "Grammar", "all": ""}
+	policy, err := LoadPolicy(zap.NewNop(), path,
+		WithCategoryLookup(func(tenant string, id int32) (string, bool, error) {
+			name, ok := categories[id]
+			return name, ok, nil
+		}),
+		WithRuleLookup(func(tenant, id string) (string, bool, error) {
+			category, ok := rules[id]
+			return category, ok, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestHTTPHandler(t *testing.T) {
+	policy := loadTestPolicy(t)
+	methods := func(req *http.Request) []string {
+		if req.URL.Path == "/unknown" {
+			return nil
+		}
+		return []string{"/grpc.sample.TicketService/CategoryScores"}
+	}
+
+	var categories map[string]bool
+	var restricted bool
+	handler := policy.HTTPHandler(methods, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		categories, restricted = AllowedCategories(req.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		role       string
+		path       string
+		code       int
+		restricted bool
+	}{
+		{name: "allowed with categories", role: "analyst", path: "/export", code: http.StatusOK, restricted: true},
+		{name: "method not allowed", role: "viewer", path: "/export", code: http.StatusForbidden},
+		{name: "path without methods", role: "analyst", path: "/unknown", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			categories, restricted = nil, false
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req = req.WithContext(NewContext(req.Context(), &Principal{Subject: "test", Roles: []string{tt.role}}))
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("got status %d, want %d", res.Code, tt.code)
+			}
+			if restricted != tt.restricted {
+				t.Fatalf("got restricted %v, want %v", restricted, tt.restricted)
+			}
+			if tt.restricted && (len(categories) != 1 || !categories["Spelling"]) {
+				t.Fatalf("got categories %v, want Spelling", categories)
+			}
+		})
+	}
+}
+
+type recordingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []interface{}
+}
+
+func (s *recordingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *recordingStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestStreamFiltersCategories(t *testing.T) {
+	policy := loadTestPolicy(t)
+	ctx := NewContext(context.Background(), &Principal{Subject: "test", Roles: []string{"analyst"}})
+	ss := &recordingStream{ctx: ctx}
+	info := &grpc.StreamServerInfo{FullMethod: "/grpc.sample.TicketService/CategoryScores"}
+
+	var sendErr error
+	err := policy.StreamServerInterceptor()(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		if err := stream.SendMsg(&pb.Categories{Categories: []*pb.Category{{Name: "Spelling"}, {Name: "Grammar"}}}); err != nil {
+			return err
+		}
+		sendErr = stream.SendMsg(&pb.OveralScoreOut{})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ss.sent) != 1 {
+		t.Fatalf("got %d sent messages, want 1", len(ss.sent))
+	}
+	categories := ss.sent[0].(*pb.Categories).Categories
+	if len(categories) != 1 || categories[0].Name != "Spelling" {
+		t.Fatalf("got categories %v, want only Spelling", categories)
+	}
+	if status.Code(sendErr) != codes.PermissionDenied {
+		t.Fatalf("got %v for overall score, want PermissionDenied", sendErr)
+	}
+}
+
+func TestRestrictedRequests(t *testing.T) {
+	policy := loadTestPolicy(t)
+	ctx := NewContext(context.Background(), &Principal{Subject: "test", Roles: []string{"editor"}})
+	interceptor := policy.UnaryServerInterceptor()
+
+	tests := []struct {
+		name    string
+		method  string
+		req     interface{}
+		resp    interface{}
+		allowed bool
+		// Responses are filtered after the handler
+		filtered bool
+	}{
+		{name: "save allowed category", method: "/grpc.sample.CategoryService/SaveCategory",
+			req: &pb.Category{Name: "Spelling"}, resp: &pb.Category{Name: "Spelling"}, allowed: true},
+		{name: "save other category", method: "/grpc.sample.CategoryService/SaveCategory",
+			req: &pb.Category{Name: "Grammar"}, resp: &pb.Category{Name: "Grammar"}},
+		{name: "create rule of allowed category", method: "/grpc.sample.AlertService/CreateRule",
+			req: &pb.AlertRule{Category: "Spelling"}, resp: &pb.AlertRule{Category: "Spelling"}, allowed: true},
+		{name: "create rule of all categories", method: "/grpc.sample.AlertService/CreateRule",
+			req: &pb.AlertRule{}, resp: &pb.AlertRule{}},
+		{name: "move rule of other category", method: "/grpc.sample.AlertService/UpdateRule",
+			req: &pb.AlertRule{Id: "grammar", Category: "Spelling"}, resp: &pb.AlertRule{Category: "Spelling"}},
+		{name: "delete rule of allowed category", method: "/grpc.sample.AlertService/DeleteRule",
+			req: &pb.AlertRuleID{Id: "spelling"}, resp: &emptypb.Empty{}, allowed: true},
+		{name: "delete rule of other category", method: "/grpc.sample.AlertService/DeleteRule",
+			req: &pb.AlertRuleID{Id: "grammar"}, resp: &emptypb.Empty{}},
+		{name: "delete rule of all categories", method: "/grpc.sample.AlertService/DeleteRule",
+			req: &pb.AlertRuleID{Id: "all"}, resp: &emptypb.Empty{}},
+		{name: "add ratings of allowed category", method: "/grpc.sample.IngestService/AddRatings",
+			req: &pb.TicketRatings{Ratings: []*pb.Rating{{CategoryId: 1}}}, resp: &emptypb.Empty{}, allowed: true},
+		{name: "add ratings of other category", method: "/grpc.sample.IngestService/AddRatings",
+			req: &pb.TicketRatings{Ratings: []*pb.Rating{{CategoryId: 1}, {CategoryId: 2}}}, resp: &emptypb.Empty{}},
+		{name: "add ticket with ratings of other category", method: "/grpc.sample.IngestService/AddTicket",
+			req: &pb.Ticket{Ratings: []*pb.Rating{{CategoryId: 2}}}, resp: &pb.Ticket{}},
+		{name: "unknown request", method: "/grpc.sample.AlertService/ListRules",
+			req: &pb.AlertRules{}, resp: &pb.AlertRules{}},
+		{name: "unknown response", method: "/grpc.sample.AlertService/ListRules",
+			req: &emptypb.Empty{}, resp: &pb.HealthCheckResponse{}, filtered: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			_, err := interceptor(ctx, tt.req, &grpc.UnaryServerInfo{FullMethod: tt.method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					called = true
+					return tt.resp, nil
+				})
+
+			if tt.allowed && err != nil {
+				t.Fatalf("call failed: %v", err)
+			}
+			if !tt.allowed && status.Code(err) != codes.PermissionDenied {
+				t.Fatalf("got %v, want PermissionDenied", err)
+			}
+			// Denied writes must not reach the handler
+			if called != (tt.allowed || tt.filtered) {
+				t.Fatalf("handler called %v", called)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_sample_db_cache_hits_total",
+		Help: "Database queries served from the cache.",
+	}, []string{"method"})
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_sample_db_cache_misses_total",
+		Help: "Database queries not found in the cache or expired.",
+	}, []string{"method"})
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_sample_db_cache_entries",
+		Help: "Query results in the cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheEntries)
+}
+
+/*
+Cache wraps db.ServiceDB and keeps query results in an LRU cache.
+Results are keyed by method, tenant and the query dates, since queries only use the date part.
+Periods that end before the current day can not get new ratings, so they are kept
+for pastTTL, other periods for ttl. Writes drop the cached results of the tenant,
+and results of queries that were running during the write are not cached.
+*/
+func New(svcDB db.ServiceDB, size int, ttl, pastTTL time.Duration) (*Cache, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create query cache")
+	}
+	return &Cache{
+		db:          svcDB,
+		entries:     entries,
+		ttl:         ttl,
+		pastTTL:     pastTTL,
+		now:         time.Now,
+		generations: map[string]uint64{},
+	}, nil
+}
+
+type Cache struct {
+	db      db.ServiceDB
+	entries *lru.Cache
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	ttl     time.Duration
+	pastTTL time.Duration
+	// Incremented when the cached results of a tenant are dropped, epoch when all of them are
+	generations map[string]uint64
+	epoch       uint64
+}
+
+// Compared before and after a load to tell whether the results were dropped meanwhile
+type generation struct {
+	epoch  uint64
+	tenant uint64
+}
+
+// Changes the TTLs while the service is running. Cached results are dropped when they change.
+func (c *Cache) SetTTL(ttl, pastTTL time.Duration) {
+	c.mu.Lock()
+	changed := ttl != c.ttl || pastTTL != c.pastTTL
+	c.ttl = ttl
+	c.pastTTL = pastTTL
+	c.mu.Unlock()
+
+	if changed {
+		c.purge()
+	}
+}
+
+// Returns the TTLs for periods that include today and for past periods
+func (c *Cache) TTL() (time.Duration, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ttl, c.pastTTL
+}
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func (c *Cache) Close() {
+	c.db.Close()
+}
+
+func (c *Cache) Ping(ctx context.Context) error {
+	return c.db.Ping(ctx)
+}
+
+func (c *Cache) DailyScores(tenant string, from, to time.Time) ([]*pb.PeriodScore, error) {
+	value, err := c.get("DailyScores", tenant, []time.Time{from, to}, func() (interface{}, error) {
+		return c.db.DailyScores(tenant, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*pb.PeriodScore), nil
+}
+
+func (c *Cache) WeeklyScores(tenant string, from, to time.Time) ([]*pb.PeriodScore, error) {
+	value, err := c.get("WeeklyScores", tenant, []time.Time{from, to}, func() (interface{}, error) {
+		return c.db.WeeklyScores(tenant, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*pb.PeriodScore), nil
+}
+
+func (c *Cache) RatingCounts(tenant string, from, to time.Time) ([]*pb.CategoryCount, error) {
+	value, err := c.get("RatingCounts", tenant, []time.Time{from, to}, func() (interface{}, error) {
+		return c.db.RatingCounts(tenant, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*pb.CategoryCount), nil
+}
+
+// Exports read the rows from the database, they are too large to cache
+func (c *Cache) EachTicketScore(tenant string, from, to time.Time, fn func(score *pb.TicketScore) error) error {
+	return db.EachTicketScore(c.db, tenant, from, to, fn)
+}
+
+func (c *Cache) TicketScores(tenant string, from, to time.Time) ([]*pb.TicketScore, error) {
+	value, err := c.get("TicketScores", tenant, []time.Time{from, to}, func() (interface{}, error) {
+		return c.db.TicketScores(tenant, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*pb.TicketScore), nil
+}
+
+func (c *Cache) OveralScore(tenant string, from, to time.Time) (int32, error) {
+	value, err := c.get("OveralScore", tenant, []time.Time{from, to}, func() (interface{}, error) {
+		return c.db.OveralScore(tenant, from, to)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value.(int32), nil
+}
+
+func (c *Cache) PeriodOverPeriod(tenant string,
+	firstFrom, firstTo, secondFrom, secondTo time.Time) ([]*pb.CategoryDiff, error) {
+
+	times := []time.Time{firstFrom, firstTo, secondFrom, secondTo}
+	value, err := c.get("PeriodOverPeriod", tenant, times, func() (interface{}, error) {
+		return c.db.PeriodOverPeriod(tenant, firstFrom, firstTo, secondFrom, secondTo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*pb.CategoryDiff), nil
+}
+
+func (c *Cache) RatingCategories(tenant string) ([]string, error) {
+	value, err := c.get("RatingCategories", tenant, nil, func() (interface{}, error) {
+		return c.db.RatingCategories(tenant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// Not cached, categories are managed through this call and should be up to date
+func (c *Cache) Categories(tenant string) ([]*pb.Category, error) {
+	return c.db.Categories(tenant)
+}
+
+func (c *Cache) SaveCategory(tenant string, category *pb.Category) (*pb.Category, error) {
+	// Weights are used in all the score queries
+	defer c.Invalidate(tenant)
+	return c.db.SaveCategory(tenant, category)
+}
+
+func (c *Cache) Tenants() ([]string, error) {
+	return c.db.Tenants()
+}
+
+func (c *Cache) AddTicket(tenant string, ticket *pb.Ticket) (int32, error) {
+	defer c.Invalidate(tenant)
+	return c.db.AddTicket(tenant, ticket)
+}
+
+func (c *Cache) AddRatings(tenant string, ticketID int32, ratings []*pb.Rating) error {
+	defer c.Invalidate(tenant)
+	return c.db.AddRatings(tenant, ticketID, ratings)
+}
+
+func (c *Cache) RebuildRollup() error {
+	defer c.purge()
+	return c.db.RebuildRollup()
+}
+
+func (c *Cache) ExportCategories(afterID int32, limit int) ([]db.CategoryRow, error) {
+	return c.db.ExportCategories(afterID, limit)
+}
+
+func (c *Cache) ExportTickets(afterID int32, limit int) ([]db.TicketRow, error) {
+	return c.db.ExportTickets(afterID, limit)
+}
+
+func (c *Cache) ExportRatings(afterID int32, limit int) ([]db.RatingRow, error) {
+	return c.db.ExportRatings(afterID, limit)
+}
+
+// Imported rows can belong to any tenant
+func (c *Cache) ImportCategories(rows []db.CategoryRow) error {
+	defer c.purge()
+	return c.db.ImportCategories(rows)
+}
+
+func (c *Cache) ImportTickets(rows []db.TicketRow) error {
+	defer c.purge()
+	return c.db.ImportTickets(rows)
+}
+
+func (c *Cache) ImportRatings(rows []db.RatingRow) error {
+	defer c.purge()
+	return c.db.ImportRatings(rows)
+}
+
+func (c *Cache) MaxIDs() (db.MaxIDs, error) {
+	return c.db.MaxIDs()
+}
+
+// Drops all the cached results
+func (c *Cache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.entries.Purge()
+	cacheEntries.Set(0)
+}
+
+// Drops all the cached results of the tenant
+func (c *Cache) Invalidate(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[tenant]++
+	prefix := tenant + "|"
+	for _, key := range c.entries.Keys() {
+		if strings.HasPrefix(key.(string), prefix) {
+			c.entries.Remove(key)
+		}
+	}
+	cacheEntries.Set(float64(c.entries.Len()))
+}
+
+/*
+Returns the cached result or loads and caches it. Errors are not cached.
+Cached values are copied so callers can modify the results.
+*/
+func (c *Cache) get(method, tenant string, times []time.Time, load func() (interface{}, error)) (interface{}, error) {
+	key := tenant + "|" + method
+	var latest time.Time
+	for _, t := range times {
+		key += "|" + t.UTC().Format(db.SimpleDateFormat)
+		if t.After(latest) {
+			latest = t
+		}
+	}
+
+	now := c.now()
+	if cached, ok := c.entries.Get(key); ok {
+		e := cached.(*entry)
+		if now.Before(e.expires) {
+			cacheHits.WithLabelValues(method).Inc()
+			return clone(e.value), nil
+		}
+		c.entries.Remove(key)
+	}
+	cacheMisses.WithLabelValues(method).Inc()
+
+	c.mu.RLock()
+	before := generation{epoch: c.epoch, tenant: c.generations[tenant]}
+	c.mu.RUnlock()
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Invalidation holds the write lock, so it can not happen between the check and adding the result
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if (generation{epoch: c.epoch, tenant: c.generations[tenant]}) != before {
+		// A write during the load may have changed the result
+		return value, nil
+	}
+
+	ttl := c.ttl
+	today := now.UTC().Truncate(24 * time.Hour)
+	if len(times) > 0 && latest.UTC().Before(today) {
+		ttl = c.pastTTL
+	}
+	c.entries.Add(key, &entry{value: clone(value), expires: now.Add(ttl)})
+	cacheEntries.Set(float64(c.entries.Len()))
+	return value, nil
+}
+
+// Copies slices of results. Protobuf messages are cloned, other values copied as they are.
+func clone(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		return value
+	}
+
+	out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		if msg, ok := item.Interface().(proto.Message); ok {
+			out.Index(i).Set(reflect.ValueOf(proto.Clone(msg)))
+		} else {
+			out.Index(i).Set(item)
+		}
+	}
+	return out.Interface()
+}
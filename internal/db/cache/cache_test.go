@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+)
+
+// Returns the score set in the test and counts the loads. Loads block while gate is set.
+type scoreDB struct {
+	*memory.MemoryDB
+
+	mu    sync.Mutex
+	score int32
+	loads int
+	gate  chan struct{}
+	// Receives a value when a blocked load has read the score
+	started chan struct{}
+}
+
+func (s *scoreDB) OveralScore(tenant string, from, to time.Time) (int32, error) {
+	s.mu.Lock()
+	score, gate := s.score, s.gate
+	s.loads++
+	s.mu.Unlock()
+
+	if gate != nil {
+		s.started <- struct{}{}
+		<-gate
+	}
+	return score, nil
+}
+
+func (s *scoreDB) set(score int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.score = score
+}
+
+func newTestCache(t *testing.T) (*Cache, *scoreDB) {
+	t.Helper()
+	svcDB := &scoreDB{MemoryDB: memory.New(), score: 1}
+	c, err := New(svcDB, 10, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, svcDB
+}
+
+var (
+	pastFrom = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	pastTo   = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func TestCachesResults(t *testing.T) {
+	c, svcDB := newTestCache(t)
+
+	for i := 0; i < 3; i++ {
+		score, err := c.OveralScore("default", pastFrom, pastTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score != 1 {
+			t.Fatalf("got score %d, want 1", score)
+		}
+	}
+	if svcDB.loads != 1 {
+		t.Fatalf("got %d loads, want 1", svcDB.loads)
+	}
+
+	svcDB.set(2)
+	c.Invalidate("default")
+	if score, _ := c.OveralScore("default", pastFrom, pastTo); score != 2 {
+		t.Fatalf("got score %d after invalidation, want 2", score)
+	}
+}
+
+func TestLoadDuringWriteIsNotCached(t *testing.T) {
+	c, svcDB := newTestCache(t)
+	svcDB.gate = make(chan struct{})
+	svcDB.started = make(chan struct{}, 1)
+
+	stale := make(chan int32)
+	go func() {
+		score, _ := c.OveralScore("default", pastFrom, pastTo)
+		stale <- score
+	}()
+
+	// The write lands and invalidates while the load that read the old score is still running
+	<-svcDB.started
+	svcDB.set(2)
+	c.Invalidate("default")
+	svcDB.mu.Lock()
+	gate := svcDB.gate
+	svcDB.gate = nil
+	svcDB.mu.Unlock()
+	close(gate)
+
+	if score := <-stale; score != 1 {
+		t.Fatalf("got score %d from the load running during the write, want 1", score)
+	}
+	if score, _ := c.OveralScore("default", pastFrom, pastTo); score != 2 {
+		t.Fatalf("got stale score %d after the write, want 2", score)
+	}
+}
@@ -1,11 +1,15 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
+	"github.com/pkg/errors"
+
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/tanelmae/grpc-sample/internal/db/migrate"
 	"github.com/tanelmae/grpc-sample/pb"
 )
 
@@ -14,15 +18,125 @@ const (
 	MaxRating        = 5
 )
 
+// Returned when a ticket or rating category does not exist for the tenant
+var ErrNotFound = errors.New("not found")
+
+/*
+All the data is scoped by tenant. Queries only see tickets, ratings and
+rating categories with the given tenant ID.
+
+Periods cover tickets created from the start of the from date until the start of the to date.
+Category score is ((rating * weight) + rating) / ((MaxRating * weight) + MaxRating) over the
+category ratings, where the weight cancels out, and the overall score weighs the categories with it.
+Weeks are labelled "YYYY WW" with weeks starting on Monday. Results are ordered by period or ticket
+and then by category ID. Package dbtest checks that implementations follow these rules.
+*/
 type ServiceDB interface {
 	Close()
-	DailyScores(from time.Time, to time.Time) ([]*pb.PeriodScore, error)
-	WeeklyScores(from time.Time, to time.Time) ([]*pb.PeriodScore, error)
-	RatingCounts(from time.Time, to time.Time) ([]*pb.CategoryCount, error)
-	TicketScores(from time.Time, to time.Time) ([]*pb.TicketScore, error)
-	OveralScore(from time.Time, to time.Time) (int32, error)
-	PeriodOverPeriod(
+	Ping(ctx context.Context) error
+	DailyScores(tenant string, from time.Time, to time.Time) ([]*pb.PeriodScore, error)
+	WeeklyScores(tenant string, from time.Time, to time.Time) ([]*pb.PeriodScore, error)
+	RatingCounts(tenant string, from time.Time, to time.Time) ([]*pb.CategoryCount, error)
+	TicketScores(tenant string, from time.Time, to time.Time) ([]*pb.TicketScore, error)
+	OveralScore(tenant string, from time.Time, to time.Time) (int32, error)
+	PeriodOverPeriod(tenant string,
 		firstFrom time.Time, firstTo time.Time,
 		secondFrom time.Time, secondTo time.Time) ([]*pb.CategoryDiff, error)
-	RatingCategories() ([]string, error)
+	RatingCategories(tenant string) ([]string, error)
+	Categories(tenant string) ([]*pb.Category, error)
+	// Creates the category or updates the weight of the existing category with the same name
+	SaveCategory(tenant string, category *pb.Category) (*pb.Category, error)
+	// Tenants that have rating categories
+	Tenants() ([]string, error)
+	// Adds the ticket with its ratings and returns the new ticket ID
+	AddTicket(tenant string, ticket *pb.Ticket) (int32, error)
+	AddRatings(tenant string, ticketID int32, ratings []*pb.Rating) error
+	// Recreates the daily_category_scores rollup from the ratings of all the tenants
+	RebuildRollup() error
+
+	// Rows of all the tenants ordered by ID, starting after the given ID
+	ExportCategories(afterID int32, limit int) ([]CategoryRow, error)
+	ExportTickets(afterID int32, limit int) ([]TicketRow, error)
+	ExportRatings(afterID int32, limit int) ([]RatingRow, error)
+	// Inserts the rows in one transaction. Rows with existing IDs are skipped.
+	ImportCategories(rows []CategoryRow) error
+	ImportTickets(rows []TicketRow) error
+	ImportRatings(rows []RatingRow) error
+	// Highest IDs in the tables, zero for empty tables
+	MaxIDs() (MaxIDs, error)
+}
+
+// Table rows for copying data between databases
+type CategoryRow struct {
+	ID     int32   `db:"id"`
+	Tenant string  `db:"tenant_id"`
+	Name   string  `db:"name"`
+	Weight float64 `db:"weight"`
+}
+
+type TicketRow struct {
+	ID        int32     `db:"id"`
+	Tenant    string    `db:"tenant_id"`
+	Subject   string    `db:"subject"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type RatingRow struct {
+	ID         int32         `db:"id"`
+	Tenant     string        `db:"tenant_id"`
+	Rating     sql.NullInt32 `db:"rating"`
+	TicketID   int32         `db:"ticket_id"`
+	CategoryID int32         `db:"rating_category_id"`
+	ReviewerID int32         `db:"reviewer_id"`
+	RevieweeID int32         `db:"reviewee_id"`
+	CreatedAt  time.Time     `db:"created_at"`
+}
+
+type MaxIDs struct {
+	Categories int32 `db:"categories"`
+	Tickets    int32 `db:"tickets"`
+	Ratings    int32 `db:"ratings"`
+}
+
+/*
+Implemented by the databases that read ticket scores row by row, so exports of long periods
+are not kept in memory. Reading stops at the first error fn returns.
+*/
+type TicketScoreReader interface {
+	EachTicketScore(tenant string, from, to time.Time, fn func(score *pb.TicketScore) error) error
+}
+
+// Reads ticket scores row by row when the database supports it, otherwise all at once
+func EachTicketScore(svcDB ServiceDB, tenant string, from, to time.Time, fn func(score *pb.TicketScore) error) error {
+	if reader, ok := svcDB.(TicketScoreReader); ok {
+		return reader.EachTicketScore(tenant, from, to, fn)
+	}
+	scores, err := svcDB.TicketScores(tenant, from, to)
+	if err != nil {
+		return err
+	}
+	for _, score := range scores {
+		if err := fn(score); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implemented by the databases with a versioned schema
+type Migratable interface {
+	Migrator() (*migrate.Migrator, error)
+}
+
+/*
+Scores for periods that start and end at midnight UTC are read from the
+daily_category_scores rollup instead of aggregating the ratings.
+*/
+func WholeDays(times ...time.Time) bool {
+	for _, t := range times {
+		if !t.Equal(t.UTC().Truncate(24 * time.Hour)) {
+			return false
+		}
+	}
+	return true
 }
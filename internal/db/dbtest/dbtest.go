@@ -0,0 +1,404 @@
+/*
+Package dbtest is a conformance suite for db.ServiceDB implementations.
+It loads the same fixture into the database under test and into the in-memory
+reference database, calls every method on both and reports the calls with different results.
+Database packages run it from their tests with Check.
+*/
+package dbtest
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Call that returned a different result than the reference database
+type Mismatch struct {
+	Call string
+	Want string
+	Got  string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s\n\twant: %s\n\tgot:  %s", m.Call, m.Want, m.Got)
+}
+
+type call struct {
+	name string
+	run  func(svcDB db.ServiceDB) (interface{}, error)
+}
+
+/*
+Run loads the fixture into the empty database and compares its results with the reference.
+Reads are checked after loading, after the write calls and after rebuilding the rollup.
+Periods are checked both as whole days, which are read from the rollup, and with times
+within the day, which are aggregated from the ratings.
+*/
+func Run(svcDB db.ServiceDB) ([]Mismatch, error) {
+	ref := memory.New()
+	if err := Load(ref); err != nil {
+		return nil, errors.Wrap(err, "failed to load reference fixture")
+	}
+	if err := Load(svcDB); err != nil {
+		return nil, errors.Wrap(err, "failed to load fixture")
+	}
+
+	mismatches := compare(ref, svcDB, "loaded", reads())
+	mismatches = append(mismatches, compare(ref, svcDB, "write", writes())...)
+	mismatches = append(mismatches, compare(ref, svcDB, "written", reads())...)
+
+	rebuild := []call{{"RebuildRollup", func(svcDB db.ServiceDB) (interface{}, error) {
+		return nil, svcDB.RebuildRollup()
+	}}}
+	mismatches = append(mismatches, compare(ref, svcDB, "rebuild", rebuild)...)
+	mismatches = append(mismatches, compare(ref, svcDB, "rebuilt", reads())...)
+	return mismatches, nil
+}
+
+// Migrates the empty database when it has a schema, runs the suite and fails the test on mismatches
+func Check(t *testing.T, svcDB db.ServiceDB) {
+	t.Helper()
+	if migratable, ok := svcDB.(db.Migratable); ok {
+		migrator, err := migratable.Migrator()
+		if err == nil {
+			_, err = migrator.Up()
+		}
+		if err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+	}
+
+	mismatches, err := Run(svcDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Error(m)
+	}
+	if err := ConcurrentWrites(svcDB); err != nil {
+		t.Error(err)
+	}
+}
+
+const concurrentWriters = 8
+
+/*
+ConcurrentWrites adds tickets with ratings and categories from several goroutines at once.
+Every call must succeed and new rows must get IDs of their own.
+*/
+func ConcurrentWrites(svcDB db.ServiceDB) error {
+	createdAt := timestamppb.New(time.Date(2019, 2, 1, 12, 0, 0, 0, time.UTC))
+	ticketIDs := make([]int32, concurrentWriters)
+	categoryIDs := make([]int32, concurrentWriters)
+	errs := make(chan error, 2*concurrentWriters)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentWriters; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			id, err := svcDB.AddTicket("default", &pb.Ticket{
+				Subject:   fmt.Sprintf("Concurrent ticket %d", i),
+				CreatedAt: createdAt,
+				Ratings:   []*pb.Rating{{CategoryId: 1, Rating: 3, CreatedAt: createdAt}},
+			})
+			ticketIDs[i] = id
+			errs <- errors.Wrap(err, "AddTicket failed")
+		}()
+		go func() {
+			defer wg.Done()
+			category, err := svcDB.SaveCategory("acme", &pb.Category{Name: fmt.Sprintf("Concurrent %d", i), Weight: 1})
+			if category != nil {
+				categoryIDs[i] = category.Id
+			}
+			errs <- errors.Wrap(err, "SaveCategory failed")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	for name, ids := range map[string][]int32{"ticket": ticketIDs, "category": categoryIDs} {
+		seen := map[int32]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				return errors.Errorf("%s ID %d was given to several rows", name, id)
+			}
+			seen[id] = true
+		}
+	}
+	return nil
+}
+
+// Calls are made in order on both databases
+func compare(ref, svcDB db.ServiceDB, stage string, calls []call) []Mismatch {
+	mismatches := []Mismatch{}
+	for _, c := range calls {
+		want := outcome(c.run(ref))
+		got := outcome(c.run(svcDB))
+		if i := difference(want, got); i >= 0 {
+			mismatches = append(mismatches, Mismatch{
+				Call: stage + " " + c.name,
+				Want: row(want, i),
+				Got:  row(got, i),
+			})
+		}
+	}
+	return mismatches
+}
+
+/*
+Result rows in a comparable form. Error messages differ between databases,
+so errors other than not found only compare equal to each other.
+*/
+type result struct {
+	rows []string
+	err  error
+}
+
+func outcome(value interface{}, err error) result {
+	switch {
+	case err == nil:
+		return result{rows: format(value)}
+	case errors.Cause(err) == db.ErrNotFound:
+		return result{rows: []string{"not found"}, err: err}
+	default:
+		return result{rows: []string{"error"}, err: err}
+	}
+}
+
+// Index of the first differing row, -1 when the results are the same
+func difference(a, b result) int {
+	for i := 0; i < len(a.rows) || i < len(b.rows); i++ {
+		if i >= len(a.rows) || i >= len(b.rows) || a.rows[i] != b.rows[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+func row(r result, i int) string {
+	if r.err != nil {
+		return r.err.Error()
+	}
+	if i >= len(r.rows) {
+		return fmt.Sprintf("%d rows", len(r.rows))
+	}
+	return fmt.Sprintf("row %d of %d: %s", i+1, len(r.rows), r.rows[i])
+}
+
+var (
+	tenants = []string{"default", "acme", "unknown"}
+	periods = []struct {
+		name     string
+		from, to time.Time
+	}{
+		{"fixture", date(2018, 12, 17), date(2019, 2, 25)},
+		{"december", date(2018, 12, 1), date(2019, 1, 1)},
+		{"week", date(2019, 1, 7), date(2019, 1, 14)},
+		{"day", date(2019, 1, 10), date(2019, 1, 11)},
+		{"empty", date(2020, 1, 1), date(2020, 2, 1)},
+	}
+	// Times within the day cover the same dates but are not read from the rollup
+	withinDay = 6 * time.Hour
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func reads() []call {
+	calls := []call{
+		{"Tenants", func(svcDB db.ServiceDB) (interface{}, error) { return svcDB.Tenants() }},
+		{"MaxIDs", func(svcDB db.ServiceDB) (interface{}, error) { return svcDB.MaxIDs() }},
+	}
+	for _, page := range []struct{ afterID, limit int32 }{{0, 10000}, {5, 3}} {
+		afterID, limit := page.afterID, int(page.limit)
+		suffix := fmt.Sprintf("(%d, %d)", afterID, limit)
+		calls = append(calls,
+			call{"ExportCategories" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+				return svcDB.ExportCategories(afterID, limit)
+			}},
+			call{"ExportTickets" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+				return svcDB.ExportTickets(afterID, limit)
+			}},
+			call{"ExportRatings" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+				return svcDB.ExportRatings(afterID, limit)
+			}},
+		)
+	}
+
+	for _, tenant := range tenants {
+		tenant := tenant
+		calls = append(calls,
+			call{"RatingCategories(" + tenant + ")", func(svcDB db.ServiceDB) (interface{}, error) {
+				return svcDB.RatingCategories(tenant)
+			}},
+			call{"Categories(" + tenant + ")", func(svcDB db.ServiceDB) (interface{}, error) {
+				return svcDB.Categories(tenant)
+			}},
+		)
+
+		for _, offset := range []time.Duration{0, withinDay} {
+			for _, p := range periods {
+				from, to := p.from.Add(offset), p.to.Add(offset)
+				suffix := fmt.Sprintf("(%s, %s %s)", tenant, p.name, offsetName(offset))
+				calls = append(calls,
+					call{"DailyScores" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+						return svcDB.DailyScores(tenant, from, to)
+					}},
+					call{"WeeklyScores" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+						return svcDB.WeeklyScores(tenant, from, to)
+					}},
+					call{"RatingCounts" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+						return svcDB.RatingCounts(tenant, from, to)
+					}},
+					call{"TicketScores" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+						return svcDB.TicketScores(tenant, from, to)
+					}},
+					call{"OveralScore" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+						return svcDB.OveralScore(tenant, from, to)
+					}},
+				)
+			}
+
+			for i := 1; i < len(periods); i++ {
+				first, second := periods[i-1], periods[i]
+				firstFrom, firstTo := first.from.Add(offset), first.to.Add(offset)
+				secondFrom, secondTo := second.from.Add(offset), second.to.Add(offset)
+				suffix := fmt.Sprintf("(%s, %s, %s %s)", tenant, first.name, second.name, offsetName(offset))
+				calls = append(calls, call{"PeriodOverPeriod" + suffix, func(svcDB db.ServiceDB) (interface{}, error) {
+					return svcDB.PeriodOverPeriod(tenant, firstFrom, firstTo, secondFrom, secondTo)
+				}})
+			}
+		}
+	}
+	return calls
+}
+
+func offsetName(offset time.Duration) string {
+	if offset == 0 {
+		return "whole days"
+	}
+	return "within day"
+}
+
+// Times are explicit so that both databases store the same rows
+func writes() []call {
+	createdAt := timestamppb.New(time.Date(2019, 1, 9, 12, 30, 0, 0, time.UTC))
+	return []call{
+		{"SaveCategory new", func(svcDB db.ServiceDB) (interface{}, error) {
+			return svcDB.SaveCategory("acme", &pb.Category{Name: "Empathy", Weight: 1.5})
+		}},
+		{"SaveCategory update", func(svcDB db.ServiceDB) (interface{}, error) {
+			return svcDB.SaveCategory("default", &pb.Category{Name: "Grammar", Weight: 0.25})
+		}},
+		{"AddTicket", func(svcDB db.ServiceDB) (interface{}, error) {
+			return svcDB.AddTicket("acme", &pb.Ticket{
+				Subject:   "Added ticket",
+				CreatedAt: createdAt,
+				Ratings: []*pb.Rating{
+					{CategoryId: 5, Rating: 4, ReviewerId: 1, RevieweeId: 2, CreatedAt: createdAt},
+					{CategoryId: 8, Rating: 1, ReviewerId: 1, RevieweeId: 2, CreatedAt: createdAt},
+				},
+			})
+		}},
+		{"AddRatings", func(svcDB db.ServiceDB) (interface{}, error) {
+			return nil, svcDB.AddRatings("default", 1, []*pb.Rating{
+				{CategoryId: 2, Rating: 3, ReviewerId: 3, RevieweeId: 4, CreatedAt: createdAt},
+			})
+		}},
+		{"AddTicket other tenant category", func(svcDB db.ServiceDB) (interface{}, error) {
+			return svcDB.AddTicket("default", &pb.Ticket{
+				Subject:   "Invalid ticket",
+				CreatedAt: createdAt,
+				Ratings:   []*pb.Rating{{CategoryId: 5, Rating: 2, CreatedAt: createdAt}},
+			})
+		}},
+		{"AddRatings other tenant ticket", func(svcDB db.ServiceDB) (interface{}, error) {
+			return nil, svcDB.AddRatings("acme", 1, []*pb.Rating{{CategoryId: 5, Rating: 2, CreatedAt: createdAt}})
+		}},
+		{"AddRatings unknown ticket", func(svcDB db.ServiceDB) (interface{}, error) {
+			return nil, svcDB.AddRatings("default", 99999, []*pb.Rating{{CategoryId: 1, Rating: 2, CreatedAt: createdAt}})
+		}},
+	}
+}
+
+// Databases return times in different time zones and weights with different precision
+func format(value interface{}) []string {
+	rows := []string{}
+	switch v := value.(type) {
+	case nil:
+		rows = append(rows, "ok")
+	case int32:
+		rows = append(rows, strconv.Itoa(int(v)))
+	case []string:
+		rows = append(rows, v...)
+	case db.MaxIDs:
+		rows = append(rows, fmt.Sprintf("categories=%d tickets=%d ratings=%d", v.Categories, v.Tickets, v.Ratings))
+	case *pb.Category:
+		rows = append(rows, fmt.Sprintf("%d|%s|%s", v.Id, v.Name, formatWeight(v.Weight)))
+	case []*pb.Category:
+		for _, c := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%s", c.Id, c.Name, formatWeight(c.Weight)))
+		}
+	case []*pb.PeriodScore:
+		for _, s := range v {
+			rows = append(rows, fmt.Sprintf("%s|%s|%s|%d", s.Id, s.Category, s.Period, s.Score))
+		}
+	case []*pb.CategoryCount:
+		for _, c := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%d", c.Id, c.Name, c.Count))
+		}
+	case []*pb.TicketScore:
+		for _, s := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%d", s.Id, s.Category, s.Score))
+		}
+	case []*pb.CategoryDiff:
+		for _, d := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%d", d.Id, d.Category, d.Diff))
+		}
+	case []db.CategoryRow:
+		for _, row := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%s|%s", row.ID, row.Tenant, row.Name, formatWeight(row.Weight)))
+		}
+	case []db.TicketRow:
+		for _, row := range v {
+			rows = append(rows, fmt.Sprintf("%d|%s|%s|%s", row.ID, row.Tenant, row.Subject, formatTime(row.CreatedAt)))
+		}
+	case []db.RatingRow:
+		for _, row := range v {
+			rating := "null"
+			if row.Rating.Valid {
+				rating = strconv.Itoa(int(row.Rating.Int32))
+			}
+			rows = append(rows, fmt.Sprintf("%d|%s|%s|%d|%d|%d|%d|%s", row.ID, row.Tenant, rating, row.TicketID,
+				row.CategoryID, row.ReviewerID, row.RevieweeID, formatTime(row.CreatedAt)))
+		}
+	default:
+		rows = append(rows, fmt.Sprintf("unexpected result %T", value))
+	}
+	return rows
+}
+
+func formatWeight(weight float64) string {
+	return strconv.FormatFloat(weight, 'g', -1, 64)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,105 @@
+package dbtest
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+const (
+	fixtureTickets = 240
+	fixtureDays    = 70
+	fixtureSeed    = 43
+)
+
+// Tickets span the turn of the year to cover week numbering
+var fixtureStart = time.Date(2018, 12, 17, 0, 0, 0, 0, time.UTC)
+
+/*
+Weights are exact in binary floating point, so databases with REAL
+and NUMERIC weights calculate the same overall scores.
+The acme tenant reuses a category name of the default tenant.
+*/
+var fixtureCategories = []db.CategoryRow{
+	{ID: 1, Tenant: "default", Name: "Spelling", Weight: 1},
+	{ID: 2, Tenant: "default", Name: "Grammar", Weight: 0.5},
+	{ID: 3, Tenant: "default", Name: "GDPR", Weight: 1.25},
+	{ID: 4, Tenant: "default", Name: "Randomness", Weight: 0},
+	{ID: 5, Tenant: "acme", Name: "Tone", Weight: 2},
+	{ID: 6, Tenant: "acme", Name: "Accuracy", Weight: 0.75},
+	{ID: 7, Tenant: "acme", Name: "Spelling", Weight: 1},
+}
+
+/*
+Fixture returns the rows loaded into every database by the conformance suite.
+The rows are generated from a fixed seed, so they are the same on every run.
+Every tenth ticket is created exactly at midnight to cover the period boundaries.
+*/
+func Fixture() ([]db.CategoryRow, []db.TicketRow, []db.RatingRow) {
+	rng := rand.New(rand.NewSource(fixtureSeed))
+
+	categories := append([]db.CategoryRow{}, fixtureCategories...)
+	tickets := []db.TicketRow{}
+	ratings := []db.RatingRow{}
+	for id := int32(1); id <= fixtureTickets; id++ {
+		tenant := "default"
+		if id%3 == 0 {
+			tenant = "acme"
+		}
+		createdAt := fixtureStart.AddDate(0, 0, rng.Intn(fixtureDays))
+		if id%10 != 0 {
+			createdAt = createdAt.Add(time.Duration(rng.Intn(24*60*60)) * time.Second)
+		}
+		tickets = append(tickets, db.TicketRow{
+			ID:        id,
+			Tenant:    tenant,
+			Subject:   fmt.Sprintf("Ticket %d", id),
+			CreatedAt: createdAt,
+		})
+
+		for _, category := range categories {
+			if category.Tenant != tenant || rng.Intn(4) == 0 {
+				continue
+			}
+			ratings = append(ratings, db.RatingRow{
+				ID:         int32(len(ratings) + 1),
+				Tenant:     tenant,
+				Rating:     sql.NullInt32{Int32: int32(rng.Intn(db.MaxRating + 1)), Valid: true},
+				TicketID:   id,
+				CategoryID: category.ID,
+				ReviewerID: int32(rng.Intn(20) + 1),
+				RevieweeID: int32(rng.Intn(20) + 1),
+				CreatedAt:  createdAt.Add(time.Duration(rng.Intn(48*60)) * time.Minute),
+			})
+		}
+	}
+	return categories, tickets, ratings
+}
+
+// Loads the fixture into the empty database and builds its rollup
+func Load(svcDB db.ServiceDB) error {
+	ids, err := svcDB.MaxIDs()
+	if err != nil {
+		return err
+	}
+	if ids != (db.MaxIDs{}) {
+		return errors.New("database is not empty")
+	}
+
+	categories, tickets, ratings := Fixture()
+	if err := svcDB.ImportCategories(categories); err != nil {
+		return err
+	}
+	if err := svcDB.ImportTickets(tickets); err != nil {
+		return err
+	}
+	if err := svcDB.ImportRatings(ratings); err != nil {
+		return err
+	}
+	return svcDB.RebuildRollup()
+}
@@ -0,0 +1,62 @@
+package dbtest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/migrate"
+)
+
+const concurrentMigrators = 4
+
+/*
+CheckConcurrentMigrations migrates an empty database from several connections at once,
+like replicas starting together. Every migration must be applied once and no migrator may fail.
+Open is called for every migrator and returns a database with a connection pool of its own.
+*/
+func CheckConcurrentMigrations(t *testing.T, open func() (db.Migratable, error)) {
+	t.Helper()
+	applied := make([][]migrate.Migration, concurrentMigrators)
+	errs := make([]error, concurrentMigrators)
+	migrators := make([]*migrate.Migrator, concurrentMigrators)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentMigrators; i++ {
+		migratable, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			migrators[i], errs[i] = migratable.Migrator()
+			if errs[i] == nil {
+				applied[i], errs[i] = migrators[i].Up()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses, err := migrators[0].Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := map[int]int{}
+	for _, migrations := range applied {
+		for _, m := range migrations {
+			versions[m.Version]++
+		}
+	}
+	for _, status := range statuses {
+		if !status.Applied || versions[status.Version] != 1 {
+			t.Errorf("migration %d %s applied %d times, recorded %v", status.Version, status.Name,
+				versions[status.Version], status.Applied)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package dbtest
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Returned by StartPostgres when the PostgreSQL server binaries are not installed
+var ErrNoPostgres = errors.New("PostgreSQL server binaries not found")
+
+const postgresUser = "conformance"
+
+/*
+StartPostgres creates a throwaway PostgreSQL cluster in dir and starts it on a free
+localhost port. Returns the connection URL and a function that stops the server.
+The cluster trusts local connections, so it must not outlive the test run.
+*/
+func StartPostgres(dir string) (string, func(), error) {
+	initdb, err := postgresBinary("initdb")
+	if err != nil {
+		return "", nil, err
+	}
+	pgCtl, err := postgresBinary("pg_ctl")
+	if err != nil {
+		return "", nil, err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := filepath.Join(dir, "pgdata")
+	out, err := exec.Command(initdb, "-D", data, "-U", postgresUser, "-A", "trust", "-E", "UTF8").CombinedOutput()
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "initdb failed: %s", out)
+	}
+
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(dir, "postgres.log"), "-w", "start").CombinedOutput()
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "starting PostgreSQL failed: %s", out)
+	}
+
+	stop := func() {
+		_ = exec.Command(pgCtl, "-D", data, "-m", "fast", "-w", "stop").Run()
+	}
+	return fmt.Sprintf("postgres://%s:%s@127.0.0.1:%d/postgres?sslmode=disable", postgresUser, postgresUser, port), stop, nil
+}
+
+/*
+Looks for the server binary on PATH and then in /usr/lib/postgresql/VERSION/bin,
+where Debian installs the server binaries. The latest version is used.
+*/
+func postgresBinary(name string) (string, error) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	paths, err := filepath.Glob(filepath.Join("/usr/lib/postgresql", "*", "bin", name))
+	if err != nil || len(paths) == 0 {
+		return "", ErrNoPostgres
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return postgresVersion(paths[i]) < postgresVersion(paths[j])
+	})
+	return paths[len(paths)-1], nil
+}
+
+// Major version from the /usr/lib/postgresql/VERSION/bin/NAME path, 0 when it is not a number
+func postgresVersion(path string) int {
+	version, _ := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(path))))
+	return version
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
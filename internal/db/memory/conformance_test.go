@@ -0,0 +1,14 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/tanelmae/grpc-sample/internal/db/dbtest"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+)
+
+func TestConformance(t *testing.T) {
+	svcDB := memory.New()
+	defer svcDB.Close()
+	dbtest.Check(t, svcDB)
+}
@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+/*
+Fixture is the JSON format for loading data into MemoryDB:
+
+	{
+	  "categories": [{"id": 1, "name": "Spelling", "weight": 1}],
+	  "tickets": [{"id": 1, "subject": "Refund", "created_at": "2019-03-01T10:00:00Z"}],
+	  "ratings": [{"id": 1, "rating": 4, "ticket_id": 1, "category_id": 1,
+	    "reviewer_id": 1, "reviewee_id": 2, "created_at": "2019-03-01T12:00:00Z"}]
+	}
+
+Every row can have a "tenant", rows without one belong to the default tenant.
+Rating can be null like in the database.
+*/
+type Fixture struct {
+	Categories []struct {
+		ID     int32   `json:"id"`
+		Tenant string  `json:"tenant"`
+		Name   string  `json:"name"`
+		Weight float64 `json:"weight"`
+	} `json:"categories"`
+	Tickets []struct {
+		ID        int32     `json:"id"`
+		Tenant    string    `json:"tenant"`
+		Subject   string    `json:"subject"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"tickets"`
+	Ratings []struct {
+		ID         int32     `json:"id"`
+		Tenant     string    `json:"tenant"`
+		Rating     *int32    `json:"rating"`
+		TicketID   int32     `json:"ticket_id"`
+		CategoryID int32     `json:"category_id"`
+		ReviewerID int32     `json:"reviewer_id"`
+		RevieweeID int32     `json:"reviewee_id"`
+		CreatedAt  time.Time `json:"created_at"`
+	} `json:"ratings"`
+}
+
+// Creates MemoryDB with the data of the JSON fixture file
+func NewFromFile(path string) (*MemoryDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open fixture")
+	}
+	defer f.Close()
+
+	m := New()
+	if err := m.Load(f); err != nil {
+		return nil, errors.Wrapf(err, "failed to load fixture %s", path)
+	}
+	return m, nil
+}
+
+// Adds the rows of the JSON fixture. Rows with existing IDs are skipped.
+func (m *MemoryDB) Load(r io.Reader) error {
+	fixture := Fixture{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fixture); err != nil {
+		return err
+	}
+
+	categories := []db.CategoryRow{}
+	for _, c := range fixture.Categories {
+		categories = append(categories, db.CategoryRow{ID: c.ID, Tenant: c.Tenant, Name: c.Name, Weight: c.Weight})
+	}
+	tickets := []db.TicketRow{}
+	for _, t := range fixture.Tickets {
+		tickets = append(tickets, db.TicketRow{ID: t.ID, Tenant: t.Tenant, Subject: t.Subject, CreatedAt: t.CreatedAt})
+	}
+	ratings := []db.RatingRow{}
+	for _, r := range fixture.Ratings {
+		row := db.RatingRow{
+			ID:         r.ID,
+			Tenant:     r.Tenant,
+			TicketID:   r.TicketID,
+			CategoryID: r.CategoryID,
+			ReviewerID: r.ReviewerID,
+			RevieweeID: r.RevieweeID,
+			CreatedAt:  r.CreatedAt,
+		}
+		if r.Rating != nil {
+			row.Rating.Int32, row.Rating.Valid = *r.Rating, true
+		}
+		ratings = append(ratings, row)
+	}
+
+	if err := m.ImportCategories(categories); err != nil {
+		return err
+	}
+	if err := m.ImportTickets(tickets); err != nil {
+		return err
+	}
+	return m.ImportRatings(ratings)
+}
@@ -0,0 +1,546 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const (
+	// Time format compared against the period dates, same as in the SQLite database
+	timeFormat = "2006-01-02 15:04:05"
+	// Tenant of rows without one, same as the database column default
+	defaultTenantID = "default"
+)
+
+/*
+MemoryDB keeps tickets, ratings and rating categories in memory and computes
+all the aggregations in Go with the same rules as the SQL databases.
+Data is lost when the process exits. Meant for tests and demos.
+*/
+func New() *MemoryDB {
+	return &MemoryDB{
+		tickets: map[int32]db.TicketRow{},
+	}
+}
+
+type MemoryDB struct {
+	mu         sync.RWMutex
+	categories []db.CategoryRow
+	tickets    map[int32]db.TicketRow
+	// Sorted by ID
+	ratings []db.RatingRow
+}
+
+func (m *MemoryDB) Close() {}
+
+func (m *MemoryDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Rating with the ticket and category it belongs to
+type joined struct {
+	rating   db.RatingRow
+	ticket   db.TicketRow
+	category db.CategoryRow
+}
+
+/*
+Ratings of the tenant for tickets created within the period. Like in the SQL queries,
+ticket creation times are compared as text against the period dates, so the period
+starts at the beginning of the from date and ends at the beginning of the to date.
+*/
+func (m *MemoryDB) ratingsIn(tenant string, from, to time.Time) []joined {
+	start, end := from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat)
+	out := []joined{}
+	for _, rating := range m.ratings {
+		if rating.Tenant != tenant {
+			continue
+		}
+		ticket, ok := m.tickets[rating.TicketID]
+		if !ok || ticket.Tenant != tenant {
+			continue
+		}
+		category, ok := m.category(tenant, rating.CategoryID)
+		if !ok {
+			continue
+		}
+		created := ticket.CreatedAt.UTC().Format(timeFormat)
+		if created < start || created > end {
+			continue
+		}
+		out = append(out, joined{rating: rating, ticket: ticket, category: category})
+	}
+	return out
+}
+
+func (m *MemoryDB) category(tenant string, id int32) (db.CategoryRow, bool) {
+	for _, category := range m.categories {
+		if category.ID == id && category.Tenant == tenant {
+			return category, true
+		}
+	}
+	return db.CategoryRow{}, false
+}
+
+// Sum and count of non-null ratings
+type total struct {
+	category db.CategoryRow
+	sum      int64
+	count    int64
+	rows     int64
+}
+
+func (t *total) add(rating db.RatingRow) {
+	t.rows++
+	if rating.Rating.Valid {
+		t.sum += int64(rating.Rating.Int32)
+		t.count++
+	}
+}
+
+// Category score, the weight cancels out within a category
+func (t *total) score() float64 {
+	return float64(t.sum) * 100.0 / (db.MaxRating * float64(t.count))
+}
+
+// Totals grouped by key and category ID, sorted by key
+func groupBy(ratings []joined, key func(j joined) string) ([]string, map[string]map[int32]*total) {
+	groups := map[string]map[int32]*total{}
+	keys := []string{}
+	for _, j := range ratings {
+		k := key(j)
+		group, ok := groups[k]
+		if !ok {
+			group = map[int32]*total{}
+			groups[k] = group
+			keys = append(keys, k)
+		}
+		t, ok := group[j.category.ID]
+		if !ok {
+			t = &total{category: j.category}
+			group[j.category.ID] = t
+		}
+		t.add(j.rating)
+	}
+	sort.Strings(keys)
+	return keys, groups
+}
+
+// Totals of the group sorted by category ID
+func sortedTotals(group map[int32]*total) []*total {
+	totals := make([]*total, 0, len(group))
+	for _, t := range group {
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].category.ID < totals[j].category.ID })
+	return totals
+}
+
+func (m *MemoryDB) periodScores(tenant string, from, to time.Time, period func(t time.Time) string) []*pb.PeriodScore {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys, groups := groupBy(m.ratingsIn(tenant, from, to), func(j joined) string {
+		return period(j.ticket.CreatedAt.UTC())
+	})
+	out := []*pb.PeriodScore{}
+	for _, key := range keys {
+		for _, t := range sortedTotals(groups[key]) {
+			out = append(out, &pb.PeriodScore{
+				Id:       fmt.Sprint(t.category.ID),
+				Category: t.category.Name,
+				Period:   key,
+				Score:    round(t.score()),
+			})
+		}
+	}
+	return out
+}
+
+func (m *MemoryDB) DailyScores(tenant string, from, to time.Time) ([]*pb.PeriodScore, error) {
+	return m.periodScores(tenant, from, to, func(t time.Time) string {
+		return t.Format(db.SimpleDateFormat)
+	}), nil
+}
+
+func (m *MemoryDB) WeeklyScores(tenant string, from, to time.Time) ([]*pb.PeriodScore, error) {
+	return m.periodScores(tenant, from, to, weekOfYear), nil
+}
+
+// Year and week of the year with weeks starting on Monday, like SQLite strftime('%Y %W')
+func weekOfYear(t time.Time) string {
+	monday := (int(t.Weekday()) + 6) % 7
+	return fmt.Sprintf("%d %02d", t.Year(), (t.YearDay()-1+7-monday)/7)
+}
+
+func (m *MemoryDB) RatingCounts(tenant string, from, to time.Time) ([]*pb.CategoryCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, groups := groupBy(m.ratingsIn(tenant, from, to), func(j joined) string { return "" })
+	out := []*pb.CategoryCount{}
+	for _, t := range sortedTotals(groups[""]) {
+		out = append(out, &pb.CategoryCount{Id: t.category.ID, Name: t.category.Name, Count: int32(t.rows)})
+	}
+	return out, nil
+}
+
+func (m *MemoryDB) TicketScores(tenant string, from, to time.Time) ([]*pb.TicketScore, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type ticketCategory struct {
+		ticketID   int32
+		categoryID int32
+	}
+	totals := map[ticketCategory]*total{}
+	keys := []ticketCategory{}
+	for _, j := range m.ratingsIn(tenant, from, to) {
+		key := ticketCategory{ticketID: j.ticket.ID, categoryID: j.category.ID}
+		t, ok := totals[key]
+		if !ok {
+			t = &total{category: j.category}
+			totals[key] = t
+			keys = append(keys, key)
+		}
+		t.add(j.rating)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ticketID != keys[j].ticketID {
+			return keys[i].ticketID < keys[j].ticketID
+		}
+		return keys[i].categoryID < keys[j].categoryID
+	})
+
+	out := []*pb.TicketScore{}
+	for _, key := range keys {
+		t := totals[key]
+		out = append(out, &pb.TicketScore{Id: key.ticketID, Category: t.category.Name, Score: round(t.score())})
+	}
+	return out, nil
+}
+
+func (m *MemoryDB) OveralScore(tenant string, from, to time.Time) (int32, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, groups := groupBy(m.ratingsIn(tenant, from, to), func(j joined) string { return "" })
+	// Categories weigh in with the rating added to the weighted rating
+	var weighted, max float64
+	for _, t := range sortedTotals(groups[""]) {
+		sum, w := float64(t.sum), t.category.Weight
+		weighted += sum*w + sum
+		max += (db.MaxRating*w + db.MaxRating) * float64(t.count)
+	}
+	return round(weighted * 100.0 / max), nil
+}
+
+func (m *MemoryDB) PeriodOverPeriod(tenant string,
+	firstFrom, firstTo, secondFrom, secondTo time.Time) ([]*pb.CategoryDiff, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	byCategory := func(j joined) string { return "" }
+	_, first := groupBy(m.ratingsIn(tenant, firstFrom, firstTo), byCategory)
+	_, second := groupBy(m.ratingsIn(tenant, secondFrom, secondTo), byCategory)
+
+	out := []*pb.CategoryDiff{}
+	for _, firstTotal := range sortedTotals(first[""]) {
+		secondTotal, ok := second[""][firstTotal.category.ID]
+		if !ok {
+			continue
+		}
+		out = append(out, &pb.CategoryDiff{
+			Id:       firstTotal.category.ID,
+			Category: firstTotal.category.Name,
+			Diff:     round(secondTotal.score()) - round(firstTotal.score()),
+		})
+	}
+	return out, nil
+}
+
+// Rounds half away from zero like SQL round. Undefined scores, e.g. of empty periods, are 0.
+func round(score float64) int32 {
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		return 0
+	}
+	return int32(math.Round(score))
+}
+
+func (m *MemoryDB) RatingCategories(tenant string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := []string{}
+	for _, category := range m.tenantCategories(tenant) {
+		out = append(out, category.Name)
+	}
+	return out, nil
+}
+
+func (m *MemoryDB) Categories(tenant string) ([]*pb.Category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := []*pb.Category{}
+	for _, category := range m.tenantCategories(tenant) {
+		out = append(out, &pb.Category{Id: category.ID, Name: category.Name, Weight: category.Weight})
+	}
+	return out, nil
+}
+
+// Categories of the tenant sorted by ID
+func (m *MemoryDB) tenantCategories(tenant string) []db.CategoryRow {
+	out := []db.CategoryRow{}
+	for _, category := range m.categories {
+		if category.Tenant == tenant {
+			out = append(out, category)
+		}
+	}
+	return out
+}
+
+// Category IDs are shared between tenants so new categories get the next free ID
+func (m *MemoryDB) SaveCategory(tenant string, category *pb.Category) (*pb.Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, existing := range m.categories {
+		if existing.Tenant == tenant && existing.Name == category.Name {
+			m.categories[i].Weight = category.Weight
+			return &pb.Category{Id: existing.ID, Name: existing.Name, Weight: category.Weight}, nil
+		}
+	}
+
+	row := db.CategoryRow{ID: m.maxIDs().Categories + 1, Tenant: tenant, Name: category.Name, Weight: category.Weight}
+	m.categories = append(m.categories, row)
+	return &pb.Category{Id: row.ID, Name: row.Name, Weight: row.Weight}, nil
+}
+
+func (m *MemoryDB) Tenants() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := map[string]bool{}
+	out := []string{}
+	for _, category := range m.categories {
+		if !seen[category.Tenant] {
+			seen[category.Tenant] = true
+			out = append(out, category.Tenant)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *MemoryDB) AddTicket(tenant string, ticket *pb.Ticket) (int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row := db.TicketRow{
+		ID:        m.maxIDs().Tickets + 1,
+		Tenant:    tenant,
+		Subject:   ticket.Subject,
+		CreatedAt: ticket.CreatedAt.AsTime().UTC(),
+	}
+	ratings, err := m.ratingRows(tenant, row.ID, ticket.Ratings)
+	if err != nil {
+		return 0, err
+	}
+	m.tickets[row.ID] = row
+	m.ratings = append(m.ratings, ratings...)
+	return row.ID, nil
+}
+
+func (m *MemoryDB) AddRatings(tenant string, ticketID int32, ratings []*pb.Rating) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ticket, ok := m.tickets[ticketID]; !ok || ticket.Tenant != tenant {
+		return errors.Wrapf(db.ErrNotFound, "ticket %d", ticketID)
+	}
+	rows, err := m.ratingRows(tenant, ticketID, ratings)
+	if err != nil {
+		return err
+	}
+	m.ratings = append(m.ratings, rows...)
+	return nil
+}
+
+// Validates the ratings and assigns them the next free IDs
+func (m *MemoryDB) ratingRows(tenant string, ticketID int32, ratings []*pb.Rating) ([]db.RatingRow, error) {
+	nextID := m.maxIDs().Ratings + 1
+	rows := []db.RatingRow{}
+	for _, rating := range ratings {
+		if _, ok := m.category(tenant, rating.CategoryId); !ok {
+			return nil, errors.Wrapf(db.ErrNotFound, "rating category %d", rating.CategoryId)
+		}
+
+		createdAt := time.Now().UTC()
+		if rating.CreatedAt != nil {
+			createdAt = rating.CreatedAt.AsTime().UTC()
+		}
+		row := db.RatingRow{
+			ID:         nextID,
+			Tenant:     tenant,
+			TicketID:   ticketID,
+			CategoryID: rating.CategoryId,
+			ReviewerID: rating.ReviewerId,
+			RevieweeID: rating.RevieweeId,
+			CreatedAt:  createdAt,
+		}
+		row.Rating.Int32, row.Rating.Valid = rating.Rating, true
+		rows = append(rows, row)
+		nextID++
+	}
+	return rows, nil
+}
+
+// Scores are always computed from the ratings, there is no rollup to rebuild
+func (m *MemoryDB) RebuildRollup() error {
+	return nil
+}
+
+func (m *MemoryDB) ExportCategories(afterID int32, limit int) ([]db.CategoryRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rows := append([]db.CategoryRow{}, m.categories...)
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	out := []db.CategoryRow{}
+	for _, row := range rows {
+		if row.ID > afterID && len(out) < limit {
+			out = append(out, row)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryDB) ExportTickets(afterID int32, limit int) ([]db.TicketRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := []db.TicketRow{}
+	for _, row := range m.tickets {
+		if row.ID > afterID {
+			out = append(out, row)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *MemoryDB) ExportRatings(afterID int32, limit int) ([]db.RatingRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.ratings), func(i int) bool { return m.ratings[i].ID > afterID })
+	end := i + limit
+	if end > len(m.ratings) {
+		end = len(m.ratings)
+	}
+	return append([]db.RatingRow{}, m.ratings[i:end]...), nil
+}
+
+func (m *MemoryDB) ImportCategories(rows []db.CategoryRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, row := range rows {
+		exists := false
+		for _, existing := range m.categories {
+			if existing.ID == row.ID {
+				exists = true
+				break
+			}
+			if existing.Tenant == row.Tenant && existing.Name == row.Name {
+				return errors.Errorf("category %q already exists for tenant %q", row.Name, row.Tenant)
+			}
+		}
+		if !exists {
+			row.Tenant = defaultTenant(row.Tenant)
+			m.categories = append(m.categories, row)
+		}
+	}
+	sort.Slice(m.categories, func(i, j int) bool { return m.categories[i].ID < m.categories[j].ID })
+	return nil
+}
+
+func (m *MemoryDB) ImportTickets(rows []db.TicketRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, row := range rows {
+		if _, ok := m.tickets[row.ID]; !ok {
+			row.Tenant = defaultTenant(row.Tenant)
+			row.CreatedAt = row.CreatedAt.UTC()
+			m.tickets[row.ID] = row
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) ImportRatings(rows []db.RatingRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := map[int32]bool{}
+	for _, row := range m.ratings {
+		existing[row.ID] = true
+	}
+	for _, row := range rows {
+		if !existing[row.ID] {
+			row.Tenant = defaultTenant(row.Tenant)
+			row.CreatedAt = row.CreatedAt.UTC()
+			m.ratings = append(m.ratings, row)
+			existing[row.ID] = true
+		}
+	}
+	sort.Slice(m.ratings, func(i, j int) bool { return m.ratings[i].ID < m.ratings[j].ID })
+	return nil
+}
+
+func (m *MemoryDB) MaxIDs() (db.MaxIDs, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxIDs(), nil
+}
+
+func (m *MemoryDB) maxIDs() db.MaxIDs {
+	var ids db.MaxIDs
+	for _, row := range m.categories {
+		if row.ID > ids.Categories {
+			ids.Categories = row.ID
+		}
+	}
+	for id := range m.tickets {
+		if id > ids.Tickets {
+			ids.Tickets = id
+		}
+	}
+	if len(m.ratings) > 0 {
+		ids.Ratings = m.ratings[len(m.ratings)-1].ID
+	}
+	return ids
+}
+
+// Rows without a tenant belong to the default tenant like in the database schema
+func defaultTenant(tenant string) string {
+	if tenant == "" {
+		return defaultTenantID
+	}
+	return tenant
+}
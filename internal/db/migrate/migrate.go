@@ -0,0 +1,353 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Migration files are named {version}_{name}.up.sql and {version}_{name}.down.sql
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const createVersionTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+/*
+Dialect has the database specific statements that keep concurrent migrators,
+e.g. replicas starting at the same time, from applying the same migration.
+*/
+type Dialect struct {
+	// Run on the migration connection before and after migrating
+	Lock   string
+	Unlock string
+	// Starts the transaction of a migration
+	Begin string
+}
+
+// Any number unique among the advisory locks of the database
+const advisoryLockKey = 4710385612
+
+var (
+	// Session level advisory lock is held while migrating
+	Postgres = Dialect{
+		Lock:   fmt.Sprintf(`SELECT pg_advisory_lock(%d);`, advisoryLockKey),
+		Unlock: fmt.Sprintf(`SELECT pg_advisory_unlock(%d);`, advisoryLockKey),
+		Begin:  `BEGIN;`,
+	}
+	// Write lock is taken when a migration starts, concurrent migrators wait for it
+	SQLite = Dialect{
+		Lock:  `PRAGMA busy_timeout = 60000;`,
+		Begin: `BEGIN IMMEDIATE;`,
+	}
+)
+
+/*
+Migrator applies versioned SQL migrations in order and keeps track of the
+applied versions in the schema_migrations table. Every migration runs in its own transaction,
+which reads the applied versions again, so a migration applied by another migrator is skipped.
+*/
+func New(db *sqlx.DB, files fs.FS, dialect Dialect) (*Migrator, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{db: db, migrations: migrations, dialect: dialect}
+
+	// Read-only databases can be opened when the table already exists
+	if _, err := db.Exec(`SELECT 1 FROM schema_migrations LIMIT 1;`); err == nil {
+		return m, nil
+	}
+	err = m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, createVersionTable)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create schema_migrations table")
+	}
+	return m, nil
+}
+
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []Migration
+	dialect    Dialect
+}
+
+// Reads the migrations from the root of files, sorted by version
+func Load(files fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, name := range names {
+		match := fileName.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, errors.Errorf("invalid migration file name %q", name)
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read migration %q", name)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, errors.Errorf("migration %d has files with different names", version)
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, errors.Errorf("migration %d has no up file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Applied versions with the time they were applied
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	return appliedVersions(context.Background(), m.db)
+}
+
+func appliedVersions(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read applied migrations")
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to read applied migrations")
+		}
+		applied[version] = appliedAt
+	}
+	return applied, errors.Wrap(rows.Err(), "failed to read applied migrations")
+}
+
+// All the known migrations and whether they have been applied
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []Status{}
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		out = append(out, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return out, nil
+}
+
+// Migrations that have not been applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Readiness check that fails while there are pending migrations
+func (m *Migrator) Check(ctx context.Context) error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.Errorf("database schema is behind, %d pending migrations", len(pending))
+	}
+	return nil
+}
+
+// Applies all the pending migrations and returns them
+func (m *Migrator) Up() ([]Migration, error) {
+	applied := []Migration{}
+	err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		for {
+			var next *Migration
+			err := m.transaction(ctx, conn, func() error {
+				versions, err := appliedVersions(ctx, conn)
+				if err != nil {
+					return err
+				}
+				for i := range m.migrations {
+					if _, ok := versions[m.migrations[i].Version]; !ok {
+						next = &m.migrations[i]
+						break
+					}
+				}
+				if next == nil {
+					return nil
+				}
+
+				if _, err := conn.ExecContext(ctx, next.Up); err != nil {
+					return errors.Wrapf(err, "migration %d %s failed", next.Version, next.Name)
+				}
+				_, err = conn.ExecContext(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2);`,
+					next.Version, next.Name)
+				return errors.Wrapf(err, "failed to record migration %d %s", next.Version, next.Name)
+			})
+			if err != nil || next == nil {
+				return err
+			}
+			applied = append(applied, *next)
+		}
+	})
+	return applied, err
+}
+
+// Reverts the latest applied migration. Returns nil when nothing is applied.
+func (m *Migrator) Down() (*Migration, error) {
+	var reverted *Migration
+	err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		return m.transaction(ctx, conn, func() error {
+			versions, err := appliedVersions(ctx, conn)
+			if err != nil {
+				return err
+			}
+
+			for i := len(m.migrations) - 1; i >= 0; i-- {
+				migration := m.migrations[i]
+				if _, ok := versions[migration.Version]; !ok {
+					continue
+				}
+				if migration.Down == "" {
+					return errors.Errorf("migration %d %s can not be reverted", migration.Version, migration.Name)
+				}
+
+				if _, err := conn.ExecContext(ctx, migration.Down); err != nil {
+					return errors.Wrapf(err, "reverting migration %d %s failed", migration.Version, migration.Name)
+				}
+				_, err = conn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version=$1;`, migration.Version)
+				if err != nil {
+					return errors.Wrapf(err, "failed to record reverting migration %d %s", migration.Version, migration.Name)
+				}
+				reverted = &migration
+				return nil
+			}
+			return nil
+		})
+	})
+	return reverted, err
+}
+
+/*
+Marks the migrations up to the version as applied and later ones as not applied
+without running them. For databases where the schema was changed by hand.
+*/
+func (m *Migrator) Force(version int) error {
+	return m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		return m.transaction(ctx, conn, func() error {
+			if _, err := conn.ExecContext(ctx, `DELETE FROM schema_migrations;`); err != nil {
+				return err
+			}
+			found := version == 0
+			for _, migration := range m.migrations {
+				if migration.Version > version {
+					break
+				}
+				found = found || migration.Version == version
+				_, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2);`,
+					migration.Version, migration.Name)
+				if err != nil {
+					return err
+				}
+			}
+			if !found {
+				return errors.Errorf("unknown migration version %d", version)
+			}
+			return nil
+		})
+	})
+}
+
+// Runs fn on a connection of its own while holding the migration lock of the dialect
+func (m *Migrator) locked(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.Lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.Lock); err != nil {
+			return errors.Wrap(err, "failed to lock migrations")
+		}
+	}
+	if m.dialect.Unlock != "" {
+		defer func() { _, _ = conn.ExecContext(ctx, m.dialect.Unlock) }()
+	}
+	return fn(ctx, conn)
+}
+
+/*
+Runs fn in a transaction started with the dialect statement, which database/sql can not
+give, and commits it when fn succeeds.
+*/
+func (m *Migrator) transaction(ctx context.Context, conn *sql.Conn, fn func() error) error {
+	if _, err := conn.ExecContext(ctx, m.dialect.Begin); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		_, _ = conn.ExecContext(ctx, `ROLLBACK;`)
+		return err
+	}
+	_, err := conn.ExecContext(ctx, `COMMIT;`)
+	return err
+}
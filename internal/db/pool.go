@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Idle connections database/sql keeps by default
+const DefaultMaxIdleConns = 2
+
+// Connection pool settings, zero values keep the database/sql defaults
+type Pool struct {
+	MaxOpenConns int
+	// Always applied, no idle connections are kept when zero
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// Statements running longer are cancelled, no limit when zero
+	StatementTimeout time.Duration
+}
+
+func (pool Pool) Apply(sqlDB *sql.DB) {
+	if pool.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	if pool.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+}
+
+// Implemented by the databases with a connection pool
+type Pooled interface {
+	Stats() sql.DBStats
+}
+
+// Implemented by the databases with read replicas, keyed by the replica name
+type Replicated interface {
+	Replicas() map[string]Pooled
+}
+
+/*
+NewStatsCollector publishes the connection pool statistics of the database with the name
+in the database label. Statistics are read from the pool on every scrape.
+*/
+func NewStatsCollector(name string, pooled Pooled) prometheus.Collector {
+	labels := prometheus.Labels{"database": name}
+	desc := func(metric, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("grpc_sample_db_"+metric, help, variableLabels, labels)
+	}
+	return &statsCollector{
+		pooled:       pooled,
+		open:         desc("open_connections", "Established connections, both in use and idle."),
+		inUse:        desc("in_use_connections", "Connections currently in use."),
+		idle:         desc("idle_connections", "Idle connections."),
+		maxOpen:      desc("max_open_connections", "Maximum open connections, zero when unlimited."),
+		waitCount:    desc("wait_count_total", "Connections waited for because the pool was exhausted."),
+		waitDuration: desc("wait_duration_seconds_total", "Time spent waiting for a connection."),
+		closed:       desc("closed_connections_total", "Connections closed by the pool limits.", "reason"),
+	}
+}
+
+type statsCollector struct {
+	pooled       Pooled
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	maxOpen      *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+	closed       *prometheus.Desc
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.maxOpen
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.closed
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pooled.Stats()
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.closed, prometheus.CounterValue, float64(stats.MaxIdleClosed), "max_idle")
+	ch <- prometheus.MustNewConstMetric(c.closed, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), "max_idle_time")
+	ch <- prometheus.MustNewConstMetric(c.closed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), "max_lifetime")
+}
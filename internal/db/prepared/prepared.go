@@ -0,0 +1,174 @@
+package prepared
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "grpc_sample_db_query_duration_seconds",
+	Help:    "Latency of the prepared database queries by the database and the method running them.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"database", "method"})
+
+func init() {
+	prometheus.MustRegister(queryDuration)
+}
+
+/*
+Statements runs prepared queries by the name of the method they belong to.
+database/sql prepares a statement again on every new connection, so statements survive
+connection resets. Errors that stale reports, e.g. the server dropping a prepared statement,
+prepare the statement again and the query is retried once.
+Queries that can not be prepared, e.g. before the schema is migrated, are prepared on first use.
+Latency is published with the name in the database label, e.g. primary or the replica name.
+*/
+func New(name string, conn *sqlx.DB, queries map[string]string, timeout time.Duration, stale func(error) bool) *Statements {
+	return &Statements{
+		name:    name,
+		conn:    conn,
+		queries: queries,
+		timeout: timeout,
+		stale:   stale,
+		stmts:   map[string]*sqlx.Stmt{},
+	}
+}
+
+type Statements struct {
+	name    string
+	conn    *sqlx.DB
+	queries map[string]string
+	// Queries are cancelled after the timeout, no limit when zero
+	timeout time.Duration
+	stale   func(error) bool
+
+	mu    sync.RWMutex
+	stmts map[string]*sqlx.Stmt
+}
+
+// Prepares the queries that are not prepared yet and returns the first error
+func (s *Statements) Prepare(ctx context.Context) error {
+	var first error
+	for method := range s.queries {
+		if _, err := s.stmt(ctx, method); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *Statements) Select(method string, dest interface{}, args ...interface{}) error {
+	return s.run(method, func(ctx context.Context, stmt *sqlx.Stmt) error {
+		return stmt.SelectContext(ctx, dest, args...)
+	})
+}
+
+func (s *Statements) Get(method string, dest interface{}, args ...interface{}) error {
+	return s.run(method, func(ctx context.Context, stmt *sqlx.Stmt) error {
+		return stmt.GetContext(ctx, dest, args...)
+	})
+}
+
+/*
+Calls scan for every row of the result without keeping the rows in memory.
+Latency covers reading all the rows. A query that fails after rows were scanned is not retried.
+*/
+func (s *Statements) Each(method string, scan func(rows *sqlx.Rows) error, args ...interface{}) error {
+	return s.run(method, func(ctx context.Context, stmt *sqlx.Stmt) error {
+		rows, err := stmt.QueryxContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		scanned := false
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return errors.Wrap(err, "failed to read row")
+			}
+			scanned = true
+		}
+		err = rows.Err()
+		if err != nil && scanned {
+			// Rows were already handed out, so the query must not be run again
+			return errors.Wrap(err, "failed to read rows")
+		}
+		return err
+	})
+}
+
+func (s *Statements) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for method, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, method)
+	}
+}
+
+func (s *Statements) run(method string, query func(ctx context.Context, stmt *sqlx.Stmt) error) error {
+	start := time.Now()
+	defer func() {
+		queryDuration.WithLabelValues(s.name, method).Observe(time.Since(start).Seconds())
+	}()
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	stmt, err := s.stmt(ctx, method)
+	if err != nil {
+		return err
+	}
+	err = query(ctx, stmt)
+	if err == nil || s.stale == nil || !s.stale(err) {
+		return err
+	}
+
+	if stmt, err = s.reprepare(ctx, method, stmt); err != nil {
+		return err
+	}
+	return query(ctx, stmt)
+}
+
+func (s *Statements) stmt(ctx context.Context, method string) (*sqlx.Stmt, error) {
+	s.mu.RLock()
+	stmt, ok := s.stmts[method]
+	s.mu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+	return s.reprepare(ctx, method, nil)
+}
+
+// Replaces the stale statement unless another call already did
+func (s *Statements) reprepare(ctx context.Context, method string, stale *sqlx.Stmt) (*sqlx.Stmt, error) {
+	query, ok := s.queries[method]
+	if !ok {
+		return nil, errors.Errorf("no query for %s", method)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stmt, ok := s.stmts[method]; ok && stmt != stale {
+		return stmt, nil
+	}
+
+	stmt, err := s.conn.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare %s query", method)
+	}
+	if stale != nil {
+		stale.Close()
+	}
+	s.stmts[method] = stmt
+	return stmt, nil
+}
@@ -0,0 +1,103 @@
+package psql
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+func (svc *psqlDB) ExportCategories(afterID int32, limit int) ([]db.CategoryRow, error) {
+	rows := []db.CategoryRow{}
+	err := svc.stmts.Select("ExportCategories", &rows, afterID, limit)
+	return rows, err
+}
+
+func (svc *psqlDB) ExportTickets(afterID int32, limit int) ([]db.TicketRow, error) {
+	rows := []db.TicketRow{}
+	err := svc.stmts.Select("ExportTickets", &rows, afterID, limit)
+	return rows, err
+}
+
+func (svc *psqlDB) ExportRatings(afterID int32, limit int) ([]db.RatingRow, error) {
+	rows := []db.RatingRow{}
+	err := svc.stmts.Select("ExportRatings", &rows, afterID, limit)
+	return rows, err
+}
+
+func (svc *psqlDB) ImportCategories(rows []db.CategoryRow) error {
+	return svc.importRows("rating_categories",
+		`INSERT INTO rating_categories(id, tenant_id, name, weight) VALUES($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Name, row.Weight)
+			return err
+		})
+}
+
+func (svc *psqlDB) ImportTickets(rows []db.TicketRow) error {
+	return svc.importRows("tickets",
+		`INSERT INTO tickets(id, tenant_id, subject, created_at) VALUES($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Subject, row.CreatedAt.UTC())
+			return err
+		})
+}
+
+func (svc *psqlDB) ImportRatings(rows []db.RatingRow) error {
+	return svc.importRows("ratings",
+		`INSERT INTO ratings(id, tenant_id, rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Rating, row.TicketID, row.CategoryID,
+				row.ReviewerID, row.RevieweeID, row.CreatedAt.UTC())
+			return err
+		})
+}
+
+func (svc *psqlDB) MaxIDs() (db.MaxIDs, error) {
+	var ids db.MaxIDs
+	err := svc.stmts.Get("MaxIDs", &ids)
+	return ids, err
+}
+
+/*
+Runs the insert statement for every row in one transaction. Rows keep their IDs,
+so the ID sequence of the table is moved past them for the rows added later.
+*/
+func (svc *psqlDB) importRows(table, query string, count int, insert func(stmt *sqlx.Stmt, i int) error) error {
+	tx, err := svc.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := 0; i < count; i++ {
+		if err := insert(stmt, i); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(
+		`SELECT setval(pg_get_serial_sequence('%s', 'id'), coalesce(max(id), 0)+1, false) FROM %s;`, table, table))
+	if err != nil {
+		return errors.Wrap(err, "failed to update ID sequence")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	svc.wrote("")
+	return nil
+}
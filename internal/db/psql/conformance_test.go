@@ -0,0 +1,50 @@
+package psql_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/dbtest"
+	"github.com/tanelmae/grpc-sample/internal/db/psql"
+)
+
+/*
+Starts a throwaway PostgreSQL cluster and returns its URL. Skips the test when the server binaries
+are not installed, unless PG_CONFORMANCE=1 is set, so CI jobs that install PostgreSQL can not pass without it.
+*/
+func startPostgres(t *testing.T) string {
+	t.Helper()
+	dsn, stop, err := dbtest.StartPostgres(t.TempDir())
+	if errors.Cause(err) == dbtest.ErrNoPostgres && os.Getenv("PG_CONFORMANCE") != "1" {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return dsn
+}
+
+func TestConformance(t *testing.T) {
+	svcDB, err := psql.New(startPostgres(t), db.Pool{MaxIdleConns: db.DefaultMaxIdleConns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svcDB.Close()
+	dbtest.Check(t, svcDB)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	dsn := startPostgres(t)
+	dbtest.CheckConcurrentMigrations(t, func() (db.Migratable, error) {
+		svcDB, err := psql.New(dsn, db.Pool{MaxIdleConns: db.DefaultMaxIdleConns})
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(svcDB.Close)
+		return svcDB.(db.Migratable), nil
+	})
+}
@@ -0,0 +1,8 @@
+-- Tables of the original database. Existing tables are left as they are,
+-- except for the weight column that pgloader creates as an integer.
+CREATE TABLE IF NOT EXISTS rating_categories(id INTEGER PRIMARY KEY, name TEXT, weight NUMERIC);
+CREATE TABLE IF NOT EXISTS tickets(id INTEGER PRIMARY KEY, subject TEXT, created_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS ratings(id INTEGER PRIMARY KEY, rating INTEGER, ticket_id INTEGER,
+	rating_category_id INTEGER, reviewer_id INTEGER, reviewee_id INTEGER, created_at TIMESTAMP);
+
+ALTER TABLE rating_categories ALTER COLUMN weight TYPE NUMERIC;
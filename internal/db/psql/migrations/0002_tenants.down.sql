@@ -0,0 +1,12 @@
+-- Only the data of the default tenant is kept
+DELETE FROM ratings WHERE tenant_id<>'default';
+DELETE FROM tickets WHERE tenant_id<>'default';
+DELETE FROM rating_categories WHERE tenant_id<>'default';
+
+DROP INDEX tickets_tenant_created_at;
+DROP INDEX ratings_tenant_ticket;
+DROP INDEX rating_categories_tenant_name;
+
+ALTER TABLE tickets DROP COLUMN tenant_id;
+ALTER TABLE ratings DROP COLUMN tenant_id;
+ALTER TABLE rating_categories DROP COLUMN tenant_id;
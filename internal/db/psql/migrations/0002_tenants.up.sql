@@ -0,0 +1,9 @@
+-- Existing data is assigned to the default tenant.
+-- Columns may already exist when the data was loaded from a migrated SQLite database.
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE ratings ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE rating_categories ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS tickets_tenant_created_at ON tickets(tenant_id, created_at);
+CREATE INDEX IF NOT EXISTS ratings_tenant_ticket ON ratings(tenant_id, ticket_id);
+CREATE UNIQUE INDEX IF NOT EXISTS rating_categories_tenant_name ON rating_categories(tenant_id, name);
@@ -0,0 +1,3 @@
+ALTER TABLE ratings ALTER COLUMN id DROP IDENTITY IF EXISTS;
+ALTER TABLE tickets ALTER COLUMN id DROP IDENTITY IF EXISTS;
+ALTER TABLE rating_categories ALTER COLUMN id DROP IDENTITY IF EXISTS;
@@ -0,0 +1,14 @@
+-- IDs are generated by the database, so concurrent inserts do not pick the same ID.
+-- Tables loaded with pgloader may already have serial columns, those keep their sequence.
+-- Sequences continue after the existing rows.
+DO $$
+DECLARE
+	t TEXT;
+BEGIN
+	FOREACH t IN ARRAY ARRAY['rating_categories', 'tickets', 'ratings'] LOOP
+		IF pg_get_serial_sequence(t, 'id') IS NULL THEN
+			EXECUTE format('ALTER TABLE %I ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY', t);
+		END IF;
+		EXECUTE format('SELECT setval(pg_get_serial_sequence(%L, ''id''), coalesce(max(id), 0)+1, false) FROM %I', t, t);
+	END LOOP;
+END $$;
@@ -0,0 +1,126 @@
+package psql
+
+/*
+Queries prepared when the database is opened, keyed by the method running them.
+Method names are the labels of the query latency histogram.
+*/
+var queries = map[string]string{
+	"DailyScores": `SELECT rating_categories.id, rating_categories.name,
+		to_char(tickets.created_at, 'YYYY-MM-DD') as period,
+		round(SUM(rating)*100.0/($1::int * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at >= $2::date AND tickets.created_at < $3::date AND ratings.tenant_id=$4
+		GROUP BY period, rating_categories.id, name
+		ORDER BY period, rating_categories.id;`,
+	"WeeklyScores": `SELECT rating_categories.id, rating_categories.name,
+		` + weekLabel("tickets.created_at") + ` as period,
+		round(SUM(rating)*100.0/($1::int * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at >= $2::date AND tickets.created_at < $3::date AND ratings.tenant_id=$4
+		GROUP BY period, rating_categories.id, name
+		ORDER BY period, rating_categories.id;`,
+	"RatingCounts": `SELECT rating_categories.id, rating_categories.name,
+		count(rating_category_id) as count
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at >= $1::date AND tickets.created_at < $2::date AND ratings.tenant_id=$3
+		GROUP BY rating_categories.id, name
+		ORDER BY rating_categories.id;`,
+	"TicketScores": `SELECT ticket_id, rating_categories.name,
+		round(SUM(rating)*100.0/($1::int * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at >= $2::date AND tickets.created_at < $3::date AND ratings.tenant_id=$4
+		GROUP BY ticket_id, rating_categories.id, name
+		ORDER BY ticket_id, rating_categories.id;`,
+	"RatingCategories": `SELECT name FROM rating_categories WHERE tenant_id=$1 ORDER BY id;`,
+	"Categories":       `SELECT id, name, weight FROM rating_categories WHERE tenant_id=$1 ORDER BY id;`,
+	"Tenants":          `SELECT DISTINCT tenant_id FROM rating_categories ORDER BY tenant_id;`,
+	"OveralScore": `SELECT coalesce(round(SUM(total * weight + total)*100.0/nullif(SUM(($1::int * weight + $1) * count), 0)), 0) as score
+		FROM (SELECT SUM(rating) as total, COUNT(rating) as count, weight
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at >= $2::date AND tickets.created_at < $3::date AND ratings.tenant_id=$4
+			GROUP BY rating_categories.id, weight) as totals;`,
+	"PeriodOverPeriod": `SELECT first.id, first.name, (second.score-first.score) as diff
+		FROM (SELECT rating_categories.id as id, rating_categories.name as name,
+			round(SUM(rating)*100.0/($1::int * COUNT(rating))) as score
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at >= $2::date AND tickets.created_at < $3::date AND ratings.tenant_id=$6
+			GROUP BY rating_categories.id) as first
+		INNER JOIN (SELECT rating_categories.id as id_2, rating_categories.name as name,
+			round(SUM(rating)*100.0/($1::int * COUNT(rating))) as score
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at >= $4::date AND tickets.created_at < $5::date AND ratings.tenant_id=$6
+			GROUP BY rating_categories.id) AS second ON id = id_2
+		ORDER BY first.id;`,
+
+	// Scores of whole days from the daily_category_scores rollup
+	"rollupDailyScores": `SELECT rating_categories.id, rating_categories.name, day as period,
+		round(SUM(rating_sum)*100.0/($1::int * SUM(rating_count))) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4
+		GROUP BY period, rating_categories.id, name
+		ORDER BY period, rating_categories.id;`,
+	"rollupWeeklyScores": `SELECT rating_categories.id, rating_categories.name,
+		` + weekLabel("day::date") + ` as period,
+		round(SUM(rating_sum)*100.0/($1::int * SUM(rating_count))) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4
+		GROUP BY period, rating_categories.id, name
+		ORDER BY period, rating_categories.id;`,
+	"rollupOveralScore": `SELECT coalesce(round(SUM(rating_sum * weight + rating_sum)*100.0/nullif(SUM(($1::int * weight + $1) * rating_count), 0)), 0) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4;`,
+	"rollupPeriodOverPeriod": `SELECT first.id, first.name, (second.score-first.score) as diff
+		FROM (SELECT rating_categories.id as id, rating_categories.name as name,
+			round(SUM(rating_sum)*100.0/($1::int * SUM(rating_count))) as score
+			FROM daily_category_scores
+			INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=daily_category_scores.tenant_id
+			WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$6
+			GROUP BY rating_categories.id) as first
+		INNER JOIN (SELECT rating_categories.id as id_2, rating_categories.name as name,
+			round(SUM(rating_sum)*100.0/($1::int * SUM(rating_count))) as score
+			FROM daily_category_scores
+			INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=daily_category_scores.tenant_id
+			WHERE day >= $4 AND day < $5 AND daily_category_scores.tenant_id=$6
+			GROUP BY rating_categories.id) AS second ON id = id_2
+		ORDER BY first.id;`,
+
+	// Rows of all the tenants for copying data between databases
+	"ExportCategories": `SELECT id, tenant_id, name, weight FROM rating_categories
+		WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"ExportTickets": `SELECT id, tenant_id, subject, created_at FROM tickets
+		WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"ExportRatings": `SELECT id, tenant_id, rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at
+		FROM ratings WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"MaxIDs": `SELECT (SELECT coalesce(max(id), 0) FROM rating_categories) as categories,
+		(SELECT coalesce(max(id), 0) FROM tickets) as tickets,
+		(SELECT coalesce(max(id), 0) FROM ratings) as ratings;`,
+}
@@ -0,0 +1,213 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/prepared"
+)
+
+const replicaPingTimeout = 2 * time.Second
+
+var replicaHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "grpc_sample_db_replica_healthy",
+	Help: "Whether the read replica passed its last health check.",
+}, []string{"database"})
+
+func init() {
+	prometheus.MustRegister(replicaHealthy)
+}
+
+type Option func(*options)
+
+type options struct {
+	logger        *zap.Logger
+	replicas      []string
+	checkInterval time.Duration
+	lagWindow     time.Duration
+}
+
+/*
+Score queries and category listings are sent round-robin to the healthy replicas.
+Writes, exports and the data they depend on are read from the primary. Replicas are
+pinged every checkInterval and reads fall back to the primary when all of them are down.
+Reads of a tenant go to the primary for lagWindow after its writes, so they are not
+answered, and cached, by a replica that has not caught up yet.
+*/
+func WithReplicas(logger *zap.Logger, dsns []string, checkInterval, lagWindow time.Duration) Option {
+	return func(o *options) {
+		o.logger = logger
+		o.replicas = dsns
+		o.checkInterval = checkInterval
+		o.lagWindow = lagWindow
+	}
+}
+
+// Times of the latest writes that replicas may not have caught up with
+type writeTimes struct {
+	mu       sync.Mutex
+	byTenant map[string]time.Time
+	// Latest write of any tenant, including the ones that change all of them
+	any time.Time
+	// Latest write that changes all the tenants, e.g. an import
+	all time.Time
+}
+
+type replica struct {
+	name  string
+	db    *sqlx.DB
+	stmts *prepared.Statements
+	// 1 when the last health check passed
+	healthy int32
+}
+
+func (r *replica) Stats() sql.DBStats {
+	return r.db.Stats()
+}
+
+// Replicas are connected lazily, so a replica that is down does not stop the service from starting
+func openReplicas(dsns []string, pool db.Pool) ([]*replica, error) {
+	replicas := []*replica{}
+	for i, dsn := range dsns {
+		if pool.StatementTimeout > 0 {
+			var err error
+			if dsn, err = withParam(dsn, "statement_timeout", pool.StatementTimeout.Milliseconds()); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := sqlx.Open("postgres", dsn)
+		if err != nil {
+			for _, r := range replicas {
+				r.db.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to open replica %d", i+1)
+		}
+		pool.Apply(conn.DB)
+		replicas = append(replicas, &replica{
+			name:  fmt.Sprintf("replica-%d", i+1),
+			db:    conn,
+			stmts: prepared.New(fmt.Sprintf("replica-%d", i+1), conn, queries, 0, staleStatement),
+		})
+	}
+	return replicas, nil
+}
+
+/*
+Replica statements for the next read of the tenant, or the primary ones when none of the replicas
+is healthy or the tenant was written to recently. Empty tenant is for reads across the tenants.
+*/
+func (svc *psqlDB) reader(tenant string) *prepared.Statements {
+	if svc.recentlyWritten(tenant) {
+		return svc.stmts
+	}
+	count := uint32(len(svc.replicas))
+	start := atomic.AddUint32(&svc.next, 1)
+	for i := uint32(0); i < count; i++ {
+		r := svc.replicas[(start+i)%count]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.stmts
+		}
+	}
+	return svc.stmts
+}
+
+// Records a successful write of the tenant. Empty tenant is for writes that change all of them.
+func (svc *psqlDB) wrote(tenant string) {
+	if len(svc.replicas) == 0 || svc.lagWindow <= 0 {
+		return
+	}
+
+	now := time.Now()
+	svc.writes.mu.Lock()
+	defer svc.writes.mu.Unlock()
+	svc.writes.any = now
+	if tenant == "" {
+		svc.writes.all = now
+		// Older tenant writes are covered by this one
+		svc.writes.byTenant = map[string]time.Time{}
+		return
+	}
+	svc.writes.byTenant[tenant] = now
+}
+
+func (svc *psqlDB) recentlyWritten(tenant string) bool {
+	if len(svc.replicas) == 0 || svc.lagWindow <= 0 {
+		return false
+	}
+
+	svc.writes.mu.Lock()
+	defer svc.writes.mu.Unlock()
+	latest := svc.writes.any
+	if tenant != "" {
+		latest = svc.writes.all
+		if t := svc.writes.byTenant[tenant]; t.After(latest) {
+			latest = t
+		}
+	}
+	return time.Since(latest) < svc.lagWindow
+}
+
+func (svc *psqlDB) Replicas() map[string]db.Pooled {
+	pools := map[string]db.Pooled{}
+	for _, r := range svc.replicas {
+		pools[r.name] = r
+	}
+	return pools
+}
+
+func (svc *psqlDB) checkReplicas() {
+	available := 0
+	for _, r := range svc.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+		err := r.db.PingContext(ctx)
+		if err == nil {
+			// Replicas that were down at startup get their queries prepared when they come up
+			_ = r.stmts.Prepare(ctx)
+		}
+		cancel()
+
+		healthy := int32(0)
+		if err == nil {
+			healthy = 1
+			available++
+		}
+		if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+			if err != nil {
+				svc.log.Warn("replica is down", zap.String("replica", r.name), zap.String("error", err.Error()))
+			} else {
+				svc.log.Info("replica is up", zap.String("replica", r.name))
+			}
+		}
+		replicaHealthy.WithLabelValues(r.name).Set(float64(healthy))
+	}
+
+	if allDown := available == 0; allDown != svc.allDown {
+		svc.allDown = allDown
+		if allDown {
+			svc.log.Warn("all replicas are down, reading from the primary")
+		}
+	}
+}
+
+func (svc *psqlDB) watchReplicas(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svc.done:
+			return
+		case <-ticker.C:
+			svc.checkReplicas()
+		}
+	}
+}
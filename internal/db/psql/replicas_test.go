@@ -0,0 +1,81 @@
+package psql
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db/prepared"
+)
+
+// Database with healthy replicas that are never connected, reads are told apart by their statements
+func newRoutingDB(replicaCount int, lagWindow time.Duration) *psqlDB {
+	svc := &psqlDB{
+		stmts:     prepared.New("primary", nil, queries, 0, nil),
+		log:       zap.NewNop(),
+		lagWindow: lagWindow,
+		writes:    writeTimes{byTenant: map[string]time.Time{}},
+	}
+	for i := 0; i < replicaCount; i++ {
+		svc.replicas = append(svc.replicas, &replica{
+			stmts:   prepared.New("replica", nil, queries, 0, nil),
+			healthy: 1,
+		})
+	}
+	return svc
+}
+
+func TestReadsGoToReplicas(t *testing.T) {
+	svc := newRoutingDB(2, time.Minute)
+
+	seen := map[*prepared.Statements]int{}
+	for i := 0; i < 4; i++ {
+		seen[svc.reader("a")]++
+	}
+	if seen[svc.stmts] != 0 || len(seen) != 2 {
+		t.Fatalf("reads are not spread over the replicas: %v", seen)
+	}
+
+	svc.replicas[0].healthy = 0
+	svc.replicas[1].healthy = 0
+	if svc.reader("a") != svc.stmts {
+		t.Fatal("read did not fall back to the primary with all the replicas down")
+	}
+}
+
+func TestReadsAfterWriteGoToPrimary(t *testing.T) {
+	svc := newRoutingDB(1, time.Minute)
+
+	svc.wrote("a")
+	if svc.reader("a") != svc.stmts {
+		t.Fatal("read of the written tenant went to a replica")
+	}
+	if svc.reader("b") == svc.stmts {
+		t.Fatal("read of another tenant went to the primary")
+	}
+	if svc.reader("") != svc.stmts {
+		t.Fatal("read across the tenants went to a replica")
+	}
+
+	svc.wrote("")
+	if svc.reader("b") != svc.stmts {
+		t.Fatal("read after a write of all the tenants went to a replica")
+	}
+}
+
+func TestReadsReturnToReplicasAfterLagWindow(t *testing.T) {
+	svc := newRoutingDB(1, 10*time.Millisecond)
+
+	svc.wrote("a")
+	time.Sleep(20 * time.Millisecond)
+	if svc.reader("a") == svc.stmts {
+		t.Fatal("read went to the primary after the lag window")
+	}
+
+	svc = newRoutingDB(1, 0)
+	svc.wrote("a")
+	if svc.reader("a") == svc.stmts {
+		t.Fatal("read went to the primary with the lag window disabled")
+	}
+}
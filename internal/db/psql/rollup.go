@@ -0,0 +1,184 @@
+package psql
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Rollup covers whole days, so period end is exclusive like in the ratings queries
+func (svc *psqlDB) rollupDailyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	ratings := []*pb.PeriodScore{}
+	err := svc.reader(tenant).Select("rollupDailyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return ratings, err
+	}
+	return ratings, nil
+}
+
+func (svc *psqlDB) rollupWeeklyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	ratings := []*pb.PeriodScore{}
+	err := svc.reader(tenant).Select("rollupWeeklyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return ratings, err
+	}
+	return ratings, nil
+}
+
+func (svc *psqlDB) rollupOveralScore(tenant string, from, to time.Time) (int32, error) {
+	var score int32
+	err := svc.reader(tenant).Get("rollupOveralScore", &score,
+		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return score, err
+	}
+	return score, nil
+}
+
+func (svc *psqlDB) rollupPeriodOverPeriod(tenant string,
+	firstFrom, firstTo, secondFrom, secondTo time.Time) ([]*pb.CategoryDiff, error) {
+
+	out := []*pb.CategoryDiff{}
+	err := svc.reader(tenant).Select("rollupPeriodOverPeriod", &out,
+		db.MaxRating, firstFrom.Format(db.SimpleDateFormat), firstTo.Format(db.SimpleDateFormat),
+		secondFrom.Format(db.SimpleDateFormat), secondTo.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+func (svc *psqlDB) RebuildRollup() error {
+	tx, err := svc.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM daily_category_scores;`); err != nil {
+		return errors.Wrap(err, "failed to clear rollup table")
+	}
+	_, err = tx.Exec(
+		`INSERT INTO daily_category_scores(tenant_id, day, rating_category_id, rating_sum, rating_count)
+		SELECT ratings.tenant_id, to_char(tickets.created_at, 'YYYY-MM-DD') as day, rating_category_id,
+		SUM(rating), COUNT(rating)
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		WHERE rating IS NOT NULL
+		GROUP BY ratings.tenant_id, day, rating_category_id;`)
+	if err != nil {
+		return errors.Wrap(err, "failed to aggregate ratings")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	svc.wrote("")
+	return nil
+}
+
+func (svc *psqlDB) AddTicket(tenant string, ticket *pb.Ticket) (int32, error) {
+	tx, err := svc.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// IDs come from the identity column, so concurrent inserts get different IDs
+	var id int32
+	err = tx.Get(&id,
+		`INSERT INTO tickets(subject, created_at, tenant_id) VALUES($1, $2, $3) RETURNING id;`,
+		ticket.Subject, ticket.CreatedAt.AsTime().UTC(), tenant)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := addRatings(tx, tenant, id, ticket.Ratings); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	svc.wrote(tenant)
+	return id, nil
+}
+
+func (svc *psqlDB) AddRatings(tenant string, ticketID int32, ratings []*pb.Rating) error {
+	tx, err := svc.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	err = tx.Get(&found, `SELECT count(*) FROM tickets WHERE id=$1 AND tenant_id=$2;`, ticketID, tenant)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return errors.Wrapf(db.ErrNotFound, "ticket %d", ticketID)
+	}
+
+	if err := addRatings(tx, tenant, ticketID, ratings); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	svc.wrote(tenant)
+	return nil
+}
+
+// Inserts the ratings and adds the inserted rows to the rollup of the ticket creation day
+func addRatings(tx *sqlx.Tx, tenant string, ticketID int32, ratings []*pb.Rating) error {
+	for _, rating := range ratings {
+		var found int
+		err := tx.Get(&found,
+			`SELECT count(*) FROM rating_categories WHERE id=$1 AND tenant_id=$2;`,
+			rating.CategoryId, tenant)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			return errors.Wrapf(db.ErrNotFound, "rating category %d", rating.CategoryId)
+		}
+
+		createdAt := time.Now().UTC()
+		if rating.CreatedAt != nil {
+			createdAt = rating.CreatedAt.AsTime().UTC()
+		}
+		var id int32
+		err = tx.Get(&id,
+			`INSERT INTO ratings(rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at, tenant_id)
+			VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id;`,
+			rating.Rating, ticketID, rating.CategoryId, rating.ReviewerId, rating.RevieweeId,
+			createdAt, tenant)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO daily_category_scores(tenant_id, day, rating_category_id, rating_sum, rating_count)
+			SELECT ratings.tenant_id, to_char(tickets.created_at, 'YYYY-MM-DD'), rating_category_id, rating, 1
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			WHERE ratings.id=$1 AND rating IS NOT NULL
+			ON CONFLICT (tenant_id, day, rating_category_id) DO UPDATE SET
+			rating_sum=daily_category_scores.rating_sum+excluded.rating_sum,
+			rating_count=daily_category_scores.rating_count+excluded.rating_count;`,
+			id)
+		if err != nil {
+			return errors.Wrap(err, "failed to update rollup")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package sqlite
+
+import (
+	"github.com/jmoiron/sqlx"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+func (sqlite *SQLiteDB) ExportCategories(afterID int32, limit int) ([]db.CategoryRow, error) {
+	rows := []db.CategoryRow{}
+	err := sqlite.stmts.Select("ExportCategories", &rows, afterID, limit)
+	return rows, err
+}
+
+func (sqlite *SQLiteDB) ExportTickets(afterID int32, limit int) ([]db.TicketRow, error) {
+	rows := []db.TicketRow{}
+	err := sqlite.stmts.Select("ExportTickets", &rows, afterID, limit)
+	return rows, err
+}
+
+func (sqlite *SQLiteDB) ExportRatings(afterID int32, limit int) ([]db.RatingRow, error) {
+	rows := []db.RatingRow{}
+	err := sqlite.stmts.Select("ExportRatings", &rows, afterID, limit)
+	return rows, err
+}
+
+func (sqlite *SQLiteDB) ImportCategories(rows []db.CategoryRow) error {
+	return sqlite.importRows(
+		`INSERT INTO rating_categories(id, tenant_id, name, weight) VALUES($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Name, row.Weight)
+			return err
+		})
+}
+
+func (sqlite *SQLiteDB) ImportTickets(rows []db.TicketRow) error {
+	return sqlite.importRows(
+		`INSERT INTO tickets(id, tenant_id, subject, created_at) VALUES($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Subject, row.CreatedAt.UTC().Format(timeFormat))
+			return err
+		})
+}
+
+func (sqlite *SQLiteDB) ImportRatings(rows []db.RatingRow) error {
+	return sqlite.importRows(
+		`INSERT INTO ratings(id, tenant_id, rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO NOTHING;`,
+		len(rows), func(stmt *sqlx.Stmt, i int) error {
+			row := rows[i]
+			_, err := stmt.Exec(row.ID, row.Tenant, row.Rating, row.TicketID, row.CategoryID,
+				row.ReviewerID, row.RevieweeID, row.CreatedAt.UTC().Format(timeFormat))
+			return err
+		})
+}
+
+func (sqlite *SQLiteDB) MaxIDs() (db.MaxIDs, error) {
+	var ids db.MaxIDs
+	err := sqlite.stmts.Get("MaxIDs", &ids)
+	return ids, err
+}
+
+// Runs the insert statement for every row in one transaction
+func (sqlite *SQLiteDB) importRows(query string, count int, insert func(stmt *sqlx.Stmt, i int) error) error {
+	sqlite.writes.Lock()
+	defer sqlite.writes.Unlock()
+
+	tx, err := sqlite.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := 0; i < count; i++ {
+		if err := insert(stmt, i); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,30 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/dbtest"
+	"github.com/tanelmae/grpc-sample/internal/db/sqlite"
+)
+
+func TestConformance(t *testing.T) {
+	svcDB, err := sqlite.New(filepath.Join(t.TempDir(), "conformance.db"), db.Pool{MaxIdleConns: db.DefaultMaxIdleConns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svcDB.Close()
+	dbtest.Check(t, svcDB)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrations.db")
+	dbtest.CheckConcurrentMigrations(t, func() (db.Migratable, error) {
+		svcDB, err := sqlite.New(path, db.Pool{MaxIdleConns: db.DefaultMaxIdleConns})
+		if err == nil {
+			t.Cleanup(svcDB.Close)
+		}
+		return svcDB, err
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !purego
+// +build !purego
+
+package sqlite
+
+// SQLite C library through cgo, the default
+import _ "github.com/mattn/go-sqlite3"
+
+const driverName = "sqlite3"
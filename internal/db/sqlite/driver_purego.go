@@ -0,0 +1,9 @@
+//go:build purego
+// +build purego
+
+package sqlite
+
+// SQLite translated to Go for builds without cgo, selected with the purego build tag
+import _ "modernc.org/sqlite"
+
+const driverName = "sqlite"
@@ -0,0 +1,3 @@
+DROP TABLE ratings;
+DROP TABLE tickets;
+DROP TABLE rating_categories;
@@ -0,0 +1,5 @@
+-- Tables of the original database file. Existing tables are left as they are.
+CREATE TABLE IF NOT EXISTS rating_categories(id INTEGER PRIMARY KEY, name TEXT, weight REAL);
+CREATE TABLE IF NOT EXISTS tickets(id INTEGER PRIMARY KEY, subject TEXT, created_at DATETIME);
+CREATE TABLE IF NOT EXISTS ratings(id INTEGER PRIMARY KEY, rating INTEGER, ticket_id INTEGER,
+	rating_category_id INTEGER, reviewer_id INTEGER, reviewee_id INTEGER, created_at DATETIME);
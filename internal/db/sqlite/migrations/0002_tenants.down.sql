@@ -0,0 +1,22 @@
+-- Only the data of the default tenant is kept.
+-- SQLite can not drop columns, so the tables are copied without the tenant_id column.
+DROP INDEX tickets_tenant_created_at;
+DROP INDEX ratings_tenant_ticket;
+DROP INDEX rating_categories_tenant_name;
+
+CREATE TABLE rating_categories_old(id INTEGER PRIMARY KEY, name TEXT, weight REAL);
+INSERT INTO rating_categories_old SELECT id, name, weight FROM rating_categories WHERE tenant_id='default';
+DROP TABLE rating_categories;
+ALTER TABLE rating_categories_old RENAME TO rating_categories;
+
+CREATE TABLE tickets_old(id INTEGER PRIMARY KEY, subject TEXT, created_at DATETIME);
+INSERT INTO tickets_old SELECT id, subject, created_at FROM tickets WHERE tenant_id='default';
+DROP TABLE tickets;
+ALTER TABLE tickets_old RENAME TO tickets;
+
+CREATE TABLE ratings_old(id INTEGER PRIMARY KEY, rating INTEGER, ticket_id INTEGER,
+	rating_category_id INTEGER, reviewer_id INTEGER, reviewee_id INTEGER, created_at DATETIME);
+INSERT INTO ratings_old SELECT id, rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at
+	FROM ratings WHERE tenant_id='default';
+DROP TABLE ratings;
+ALTER TABLE ratings_old RENAME TO ratings;
@@ -0,0 +1,8 @@
+-- Existing data is assigned to the default tenant
+ALTER TABLE tickets ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE ratings ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE rating_categories ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX tickets_tenant_created_at ON tickets(tenant_id, created_at);
+CREATE INDEX ratings_tenant_ticket ON ratings(tenant_id, ticket_id);
+CREATE UNIQUE INDEX rating_categories_tenant_name ON rating_categories(tenant_id, name);
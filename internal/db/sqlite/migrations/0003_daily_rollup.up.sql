@@ -0,0 +1,21 @@
+-- Daily rollup of ratings by ticket creation day and category.
+-- Sums and counts are kept instead of scores so weights can change without a rebuild
+-- and scores of longer periods can be summed up from the days.
+CREATE TABLE IF NOT EXISTS daily_category_scores (
+	tenant_id TEXT NOT NULL,
+	day TEXT NOT NULL,
+	rating_category_id INTEGER NOT NULL,
+	rating_sum INTEGER NOT NULL,
+	rating_count INTEGER NOT NULL,
+	PRIMARY KEY (tenant_id, day, rating_category_id)
+);
+
+-- Table may exist from the rebuild-rollup command
+DELETE FROM daily_category_scores;
+INSERT INTO daily_category_scores(tenant_id, day, rating_category_id, rating_sum, rating_count)
+SELECT ratings.tenant_id, strftime('%Y-%m-%d', tickets.created_at) as day, rating_category_id,
+SUM(rating), COUNT(rating)
+FROM ratings
+INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+WHERE rating IS NOT NULL
+GROUP BY ratings.tenant_id, day, rating_category_id;
@@ -0,0 +1,130 @@
+package sqlite
+
+/*
+Queries prepared when the database is opened, keyed by the method running them.
+Method names are the labels of the query latency histogram.
+*/
+var queries = map[string]string{
+	"DailyScores": `SELECT rating_categories.id, rating_categories.name,
+		strftime('%Y-%m-%d', tickets.created_at) as period,
+		round(SUM(rating)*100.0/($1 * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at BETWEEN $2 AND $3 AND ratings.tenant_id=$4
+		GROUP BY period, rating_categories.id
+		ORDER BY period, rating_categories.id;`,
+	"WeeklyScores": `SELECT rating_categories.id, rating_categories.name,
+		strftime('%Y %W', tickets.created_at) as period,
+		round(SUM(rating)*100.0/($1 * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at BETWEEN $2 AND $3 AND ratings.tenant_id=$4
+		GROUP BY period, rating_categories.id
+		ORDER BY period, rating_categories.id;`,
+	"RatingCounts": `SELECT rating_categories.id, rating_categories.name,
+		count(rating_category_id) as count
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at BETWEEN $1 AND $2 AND ratings.tenant_id=$3
+		GROUP BY rating_categories.id
+		ORDER BY rating_categories.id;`,
+	"TicketScores": `SELECT ticket_id, rating_categories.name,
+		round(SUM(rating)*100.0/($1 * COUNT(rating))) as score
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=ratings.tenant_id
+		WHERE tickets.created_at BETWEEN $2 AND $3 AND ratings.tenant_id=$4
+		GROUP BY ticket_id, rating_categories.id
+		ORDER BY ticket_id, rating_categories.id;`,
+	"RatingCategories": `SELECT name FROM rating_categories WHERE tenant_id=$1 ORDER BY id;`,
+	"Categories":       `SELECT id, name, weight FROM rating_categories WHERE tenant_id=$1 ORDER BY id;`,
+	"Tenants":          `SELECT DISTINCT tenant_id FROM rating_categories ORDER BY tenant_id;`,
+	"OveralScore": `SELECT ifnull(round(SUM(total * weight + total)*100.0/SUM(($1 * weight + $1) * count)), 0) as score
+		FROM (SELECT SUM(rating) as total, COUNT(rating) as count, weight
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at BETWEEN $2 AND $3 AND ratings.tenant_id=$4
+			GROUP BY rating_categories.id);`,
+	// go-sqlite3 binds arguments in the order the parameters first appear and modernc.org/sqlite
+	// by their number, so parameters have to be numbered in the order they appear
+	"PeriodOverPeriod": `SELECT id, name, (score_2-score_1) as diff
+		FROM (SELECT rating_categories.id as id, rating_categories.name as name,
+			round(SUM(rating)*100.0/($1 * COUNT(rating))) as score_1
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at BETWEEN $2 AND $3 AND ratings.tenant_id=$4
+			GROUP BY rating_categories.id)
+		INNER JOIN (SELECT rating_categories.id as id_2,
+			round(SUM(rating)*100.0/($1 * COUNT(rating))) as score_2
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=ratings.tenant_id
+			WHERE tickets.created_at BETWEEN $5 AND $6 AND ratings.tenant_id=$4
+			GROUP BY rating_categories.id) ON id = id_2
+		ORDER BY id;`,
+
+	// Scores of whole days from the daily_category_scores rollup
+	"rollupDailyScores": `SELECT rating_categories.id, rating_categories.name, day as period,
+		round(SUM(rating_sum)*100.0/($1 * SUM(rating_count))) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4
+		GROUP BY period, rating_categories.id
+		ORDER BY period, rating_categories.id;`,
+	"rollupWeeklyScores": `SELECT rating_categories.id, rating_categories.name,
+		strftime('%Y %W', day) as period,
+		round(SUM(rating_sum)*100.0/($1 * SUM(rating_count))) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4
+		GROUP BY period, rating_categories.id
+		ORDER BY period, rating_categories.id;`,
+	"rollupOveralScore": `SELECT ifnull(round(SUM(rating_sum * weight + rating_sum)*100.0/SUM(($1 * weight + $1) * rating_count)), 0) as score
+		FROM daily_category_scores
+		INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+			AND rating_categories.tenant_id=daily_category_scores.tenant_id
+		WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4;`,
+	// go-sqlite3 binds arguments in the order the parameters first appear and modernc.org/sqlite
+	// by their number, so parameters have to be numbered in the order they appear
+	"rollupPeriodOverPeriod": `SELECT id, name, (score_2-score_1) as diff
+		FROM (SELECT rating_categories.id as id, rating_categories.name as name,
+			round(SUM(rating_sum)*100.0/($1 * SUM(rating_count))) as score_1
+			FROM daily_category_scores
+			INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=daily_category_scores.tenant_id
+			WHERE day >= $2 AND day < $3 AND daily_category_scores.tenant_id=$4
+			GROUP BY rating_categories.id)
+		INNER JOIN (SELECT rating_categories.id as id_2,
+			round(SUM(rating_sum)*100.0/($1 * SUM(rating_count))) as score_2
+			FROM daily_category_scores
+			INNER JOIN rating_categories ON daily_category_scores.rating_category_id=rating_categories.id
+				AND rating_categories.tenant_id=daily_category_scores.tenant_id
+			WHERE day >= $5 AND day < $6 AND daily_category_scores.tenant_id=$4
+			GROUP BY rating_categories.id) ON id = id_2
+		ORDER BY id;`,
+
+	// Rows of all the tenants for copying data between databases
+	"ExportCategories": `SELECT id, tenant_id, name, weight FROM rating_categories
+		WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"ExportTickets": `SELECT id, tenant_id, subject, created_at FROM tickets
+		WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"ExportRatings": `SELECT id, tenant_id, rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at
+		FROM ratings WHERE id > $1 ORDER BY id LIMIT $2;`,
+	"MaxIDs": `SELECT (SELECT coalesce(max(id), 0) FROM rating_categories) as categories,
+		(SELECT coalesce(max(id), 0) FROM tickets) as tickets,
+		(SELECT coalesce(max(id), 0) FROM ratings) as ratings;`,
+}
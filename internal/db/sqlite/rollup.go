@@ -0,0 +1,194 @@
+package sqlite
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Format of the ticket and rating times stored by the service
+const timeFormat = "2006-01-02 15:04:05"
+
+/*
+Rollup covers whole days, so period end is exclusive like in the ratings queries
+where the end date compares smaller than any time on that day.
+Scores are calculated from per category sums like in the ratings queries.
+*/
+func (sqlite *SQLiteDB) rollupDailyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	ratings := []*pb.PeriodScore{}
+	err := sqlite.stmts.Select("rollupDailyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return ratings, err
+	}
+	return ratings, nil
+}
+
+func (sqlite *SQLiteDB) rollupWeeklyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	ratings := []*pb.PeriodScore{}
+	err := sqlite.stmts.Select("rollupWeeklyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return ratings, err
+	}
+	return ratings, nil
+}
+
+func (sqlite *SQLiteDB) rollupOveralScore(tenant string, from, to time.Time) (int32, error) {
+	var score int32
+	err := sqlite.stmts.Get("rollupOveralScore", &score,
+		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), tenant)
+
+	if err != nil {
+		return score, err
+	}
+	return score, nil
+}
+
+func (sqlite *SQLiteDB) rollupPeriodOverPeriod(tenant string,
+	firstFrom, firstTo, secondFrom, secondTo time.Time) ([]*pb.CategoryDiff, error) {
+
+	out := []*pb.CategoryDiff{}
+	err := sqlite.stmts.Select("rollupPeriodOverPeriod", &out,
+		db.MaxRating, firstFrom.Format(db.SimpleDateFormat), firstTo.Format(db.SimpleDateFormat), tenant,
+		secondFrom.Format(db.SimpleDateFormat), secondTo.Format(db.SimpleDateFormat))
+
+	if err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+func (sqlite *SQLiteDB) RebuildRollup() error {
+	sqlite.writes.Lock()
+	defer sqlite.writes.Unlock()
+
+	tx, err := sqlite.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM daily_category_scores;`); err != nil {
+		return errors.Wrap(err, "failed to clear rollup table")
+	}
+	_, err = tx.Exec(
+		`INSERT INTO daily_category_scores(tenant_id, day, rating_category_id, rating_sum, rating_count)
+		SELECT ratings.tenant_id, strftime('%Y-%m-%d', tickets.created_at) as day, rating_category_id,
+		SUM(rating), COUNT(rating)
+		FROM ratings
+		INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+		WHERE rating IS NOT NULL
+		GROUP BY ratings.tenant_id, day, rating_category_id;`)
+	if err != nil {
+		return errors.Wrap(err, "failed to aggregate ratings")
+	}
+	return tx.Commit()
+}
+
+func (sqlite *SQLiteDB) AddTicket(tenant string, ticket *pb.Ticket) (int32, error) {
+	sqlite.writes.Lock()
+	defer sqlite.writes.Unlock()
+
+	tx, err := sqlite.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// INTEGER PRIMARY KEY is the rowid, which SQLite assigns to rows inserted without an ID
+	res, err := tx.Exec(
+		`INSERT INTO tickets(subject, created_at, tenant_id) VALUES($1, $2, $3);`,
+		ticket.Subject, ticket.CreatedAt.AsTime().UTC().Format(timeFormat), tenant)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := addRatings(tx, tenant, int32(id), ticket.Ratings); err != nil {
+		return 0, err
+	}
+	return int32(id), tx.Commit()
+}
+
+func (sqlite *SQLiteDB) AddRatings(tenant string, ticketID int32, ratings []*pb.Rating) error {
+	sqlite.writes.Lock()
+	defer sqlite.writes.Unlock()
+
+	tx, err := sqlite.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	err = tx.Get(&found, `SELECT count(*) FROM tickets WHERE id=$1 AND tenant_id=$2;`, ticketID, tenant)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return errors.Wrapf(db.ErrNotFound, "ticket %d", ticketID)
+	}
+
+	if err := addRatings(tx, tenant, ticketID, ratings); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Inserts the ratings and adds the inserted rows to the rollup of the ticket creation day
+func addRatings(tx *sqlx.Tx, tenant string, ticketID int32, ratings []*pb.Rating) error {
+	for _, rating := range ratings {
+		var found int
+		err := tx.Get(&found,
+			`SELECT count(*) FROM rating_categories WHERE id=$1 AND tenant_id=$2;`,
+			rating.CategoryId, tenant)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			return errors.Wrapf(db.ErrNotFound, "rating category %d", rating.CategoryId)
+		}
+
+		createdAt := time.Now().UTC()
+		if rating.CreatedAt != nil {
+			createdAt = rating.CreatedAt.AsTime().UTC()
+		}
+		res, err := tx.Exec(
+			`INSERT INTO ratings(rating, ticket_id, rating_category_id, reviewer_id, reviewee_id, created_at, tenant_id)
+			VALUES($1, $2, $3, $4, $5, $6, $7);`,
+			rating.Rating, ticketID, rating.CategoryId, rating.ReviewerId, rating.RevieweeId,
+			createdAt.Format(timeFormat), tenant)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO daily_category_scores(tenant_id, day, rating_category_id, rating_sum, rating_count)
+			SELECT ratings.tenant_id, strftime('%Y-%m-%d', tickets.created_at), rating_category_id, rating, 1
+			FROM ratings
+			INNER JOIN tickets ON ratings.ticket_id=tickets.id AND tickets.tenant_id=ratings.tenant_id
+			WHERE ratings.id=$1 AND rating IS NOT NULL
+			ON CONFLICT (tenant_id, day, rating_category_id) DO UPDATE SET
+			rating_sum=daily_category_scores.rating_sum+excluded.rating_sum,
+			rating_count=daily_category_scores.rating_count+excluded.rating_count;`,
+			id)
+		if err != nil {
+			return errors.Wrap(err, "failed to update rollup")
+		}
+	}
+	return nil
+}
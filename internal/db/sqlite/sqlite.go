@@ -1,48 +1,105 @@
 package sqlite
 
 import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 
 	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/migrate"
+	"github.com/tanelmae/grpc-sample/internal/db/prepared"
 	"github.com/tanelmae/grpc-sample/pb"
 )
 
-func New(dbPath string) (*SQLiteDB, error) {
-	sqliteDB, err := sqlx.Open("sqlite3", dbPath)
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Opens the database file or file: URI with the pool settings
+func New(dbPath string, pool db.Pool) (*SQLiteDB, error) {
+	sqliteDB, err := sqlx.Open(driverName, dbPath)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open sqlite DB")
 	}
+	pool.Apply(sqliteDB.DB)
+
+	// SQLite has no statement timeout of its own, so the queries are interrupted after it.
+	// Tables of a new database are created by migrations, so its queries are prepared on first use.
+	stmts := prepared.New("primary", sqliteDB, queries, pool.StatementTimeout, nil)
+	_ = stmts.Prepare(context.Background())
 
 	return &SQLiteDB{
-		db: sqliteDB,
+		db:    sqliteDB,
+		stmts: stmts,
 	}, nil
 }
 
+/*
+ParseURL converts sqlite://PATH?PARAMS to the file: URI understood by the driver,
+e.g. sqlite:///var/lib/service.db?mode=ro. Relative paths are given as sqlite://PATH
+or sqlite:PATH and URLs without parameters are returned as the plain path.
+*/
+func ParseURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "sqlite" {
+		return "", errors.Errorf("invalid SQLite URL %q", rawURL)
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return "", errors.Errorf("no database path in %q", rawURL)
+	}
+	if u.RawQuery == "" {
+		return path, nil
+	}
+	return "file:" + path + "?" + u.RawQuery, nil
+}
+
 type SQLiteDB struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	stmts *prepared.Statements
+	// SQLite allows one writer at a time, so concurrent writes wait here instead of failing as busy
+	writes sync.Mutex
+}
+
+func (sqlite *SQLiteDB) Migrator() (*migrate.Migrator, error) {
+	files, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(sqlite.db, files, migrate.SQLite)
 }
 
 func (sqlite *SQLiteDB) Close() {
+	sqlite.stmts.Close()
 	sqlite.db.Close()
 }
 
-func (sqlite *SQLiteDB) DailyScores(start, end time.Time) ([]*pb.PeriodScore, error) {
+func (sqlite *SQLiteDB) Ping(ctx context.Context) error {
+	return sqlite.db.PingContext(ctx)
+}
+
+func (sqlite *SQLiteDB) Stats() sql.DBStats {
+	return sqlite.db.Stats()
+}
+
+func (sqlite *SQLiteDB) DailyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	if db.WholeDays(start, end) {
+		return sqlite.rollupDailyScores(tenant, start, end)
+	}
+
 	ratings := []*pb.PeriodScore{}
-	err := sqlite.db.Select(&ratings,
-		`SELECT rating_categories.id, rating_categories.name,
-		strftime('%Y-%m-%d', tickets.created_at) as period,
-		round(AVG((rating * weight)+rating)/AVG(($1 * weight)+$1)*100) as score
-		FROM ratings
-		INNER JOIN tickets ON ratings.ticket_id=tickets.id
-		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-		WHERE tickets.created_at BETWEEN $2 AND $3
-		GROUP BY period, name;`,
-		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat))
+	err := sqlite.stmts.Select("DailyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
 
 	if err != nil {
 		return ratings, err
@@ -50,17 +107,14 @@ func (sqlite *SQLiteDB) DailyScores(start, end time.Time) ([]*pb.PeriodScore, er
 	return ratings, nil
 }
 
-func (sqlite *SQLiteDB) WeeklyScores(start, end time.Time) ([]*pb.PeriodScore, error) {
+func (sqlite *SQLiteDB) WeeklyScores(tenant string, start, end time.Time) ([]*pb.PeriodScore, error) {
+	if db.WholeDays(start, end) {
+		return sqlite.rollupWeeklyScores(tenant, start, end)
+	}
+
 	ratings := []*pb.PeriodScore{}
-	err := sqlite.db.Select(&ratings,
-		`SELECT rating_categories.id, rating_categories.name,
-		strftime('%W', tickets.created_at) as period,
-		round(AVG((rating * weight)+rating)/AVG(($1 * weight)+$1)*100) as score
-		FROM ratings
-		INNER JOIN tickets ON ratings.ticket_id=tickets.id
-		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-		WHERE tickets.created_at BETWEEN $2 AND $3
-		GROUP BY period, name;`, db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat))
+	err := sqlite.stmts.Select("WeeklyScores", &ratings,
+		db.MaxRating, start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
 
 	if err != nil {
 		return ratings, err
@@ -69,18 +123,10 @@ func (sqlite *SQLiteDB) WeeklyScores(start, end time.Time) ([]*pb.PeriodScore, e
 	return ratings, nil
 }
 
-func (sqlite *SQLiteDB) RatingCounts(start, end time.Time) ([]*pb.CategoryCount, error) {
+func (sqlite *SQLiteDB) RatingCounts(tenant string, start, end time.Time) ([]*pb.CategoryCount, error) {
 	counts := []*pb.CategoryCount{}
-	err := sqlite.db.Select(&counts,
-		`SELECT rating_categories.id, rating_categories.name,
-		count(rating_category_id) as count
-		FROM ratings
-		INNER JOIN tickets ON ratings.ticket_id=tickets.id
-		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-		WHERE tickets.created_at BETWEEN $1 AND $2
-		GROUP BY name
-		ORDER BY rating_categories.id ASC;`,
-		start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat))
+	err := sqlite.stmts.Select("RatingCounts", &counts,
+		start.Format(db.SimpleDateFormat), end.Format(db.SimpleDateFormat), tenant)
 
 	if err != nil {
 		return nil, err
@@ -92,17 +138,10 @@ func (sqlite *SQLiteDB) RatingCounts(start, end time.Time) ([]*pb.CategoryCount,
 Aggregate scores for categories within defined period by ticket.
 E.g. what aggregate category scores tickets have within defined rating time range have.
 */
-func (sqlite *SQLiteDB) TicketScores(from time.Time, to time.Time) ([]*pb.TicketScore, error) {
+func (sqlite *SQLiteDB) TicketScores(tenant string, from time.Time, to time.Time) ([]*pb.TicketScore, error) {
 	scores := []*pb.TicketScore{}
-	err := sqlite.db.Select(&scores,
-		`SELECT ticket_id, rating_categories.name,
-		round(AVG((rating * weight)+rating)/AVG(($1 * weight)+$1)*100) as score
-		FROM ratings
-		INNER JOIN tickets ON ratings.ticket_id=tickets.id
-		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-				WHERE tickets.created_at BETWEEN $2 AND $3
-		GROUP BY ticket_id, name;`,
-		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat))
+	err := sqlite.stmts.Select("TicketScores", &scores,
+		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), tenant)
 
 	if err != nil {
 		return nil, err
@@ -111,10 +150,30 @@ func (sqlite *SQLiteDB) TicketScores(from time.Time, to time.Time) ([]*pb.Ticket
 	return scores, nil
 }
 
-func (sqlite *SQLiteDB) RatingCategories() ([]string, error) {
+func (sqlite *SQLiteDB) EachTicketScore(tenant string, from, to time.Time, fn func(score *pb.TicketScore) error) error {
+	return sqlite.stmts.Each("TicketScores", func(rows *sqlx.Rows) error {
+		score := &pb.TicketScore{}
+		if err := rows.StructScan(score); err != nil {
+			return err
+		}
+		return fn(score)
+	}, db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), tenant)
+}
+
+func (sqlite *SQLiteDB) RatingCategories(tenant string) ([]string, error) {
 	categories := []string{}
-	err := sqlite.db.Select(&categories,
-		`SELECT name FROM rating_categories;`)
+	err := sqlite.stmts.Select("RatingCategories", &categories, tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+func (sqlite *SQLiteDB) Categories(tenant string) ([]*pb.Category, error) {
+	categories := []*pb.Category{}
+	err := sqlite.stmts.Select("Categories", &categories, tenant)
 
 	if err != nil {
 		return nil, err
@@ -123,21 +182,57 @@ func (sqlite *SQLiteDB) RatingCategories() ([]string, error) {
 	return categories, nil
 }
 
+/*
+Category IDs are shared between tenants. New categories are inserted without an ID
+and get the rowid SQLite assigns, existing ones keep their ID and get the new weight.
+*/
+func (sqlite *SQLiteDB) SaveCategory(tenant string, category *pb.Category) (*pb.Category, error) {
+	sqlite.writes.Lock()
+	defer sqlite.writes.Unlock()
+
+	_, err := sqlite.db.Exec(
+		`INSERT INTO rating_categories(name, weight, tenant_id) VALUES($1, $2, $3)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET weight=excluded.weight;`,
+		category.Name, category.Weight, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := &pb.Category{}
+	err = sqlite.db.Get(saved,
+		`SELECT id, name, weight FROM rating_categories WHERE tenant_id=$1 AND name=$2;`,
+		tenant, category.Name)
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (sqlite *SQLiteDB) Tenants() ([]string, error) {
+	tenants := []string{}
+	err := sqlite.stmts.Select("Tenants", &tenants)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
 /*
 Overal quality score
 
 What is the overall aggregate score for a period.
 E.g. the overall score over past week has been 96%.
 */
-func (sqlite *SQLiteDB) OveralScore(from time.Time, to time.Time) (int32, error) {
+func (sqlite *SQLiteDB) OveralScore(tenant string, from time.Time, to time.Time) (int32, error) {
+	if db.WholeDays(from, to) {
+		return sqlite.rollupOveralScore(tenant, from, to)
+	}
+
 	var score int32
-	err := sqlite.db.Get(&score,
-		`SELECT round(AVG(rating * weight)/AVG($1 * weight)*100) as score
-		FROM ratings
-		INNER JOIN tickets ON ratings.ticket_id=tickets.id
-		INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-		WHERE tickets.created_at BETWEEN $2 AND $3;`,
-		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat))
+	err := sqlite.stmts.Get("OveralScore", &score,
+		db.MaxRating, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), tenant)
 
 	if err != nil {
 		return score, err
@@ -151,31 +246,17 @@ Period over Period score change
 What has been the change from selected period over previous period.
 E.g. current week vs. previous week or December vs. January change in percentages.
 */
-func (sqlite *SQLiteDB) PeriodOverPeriod(
+func (sqlite *SQLiteDB) PeriodOverPeriod(tenant string,
 	firstFrom time.Time, firstTo time.Time,
 	secondFrom time.Time, secondTo time.Time) ([]*pb.CategoryDiff, error) {
 
+	if db.WholeDays(firstFrom, firstTo, secondFrom, secondTo) {
+		return sqlite.rollupPeriodOverPeriod(tenant, firstFrom, firstTo, secondFrom, secondTo)
+	}
+
 	out := []*pb.CategoryDiff{}
-	err := sqlite.db.Select(&out,
-		`SELECT id, name, (score_2-score_1) as diff
-		FROM (SELECT rating_categories.id as id, rating_categories.name as name,
-			ifnull(round(AVG(rating * weight)/AVG($1 * weight)*100),0) as score_1
-			FROM ratings
-			INNER JOIN tickets ON ratings.ticket_id=tickets.id
-			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-			WHERE tickets.created_at BETWEEN $2 AND $3
-			GROUP BY name
-			ORDER BY rating_categories.id ASC)
-		INNER JOIN (SELECT rating_categories.id as id_2,
-			ifnull(round(AVG(rating * weight)/AVG($1 * weight)*100),0) as score_2
-			FROM ratings
-			INNER JOIN tickets ON ratings.ticket_id=tickets.id
-			INNER JOIN rating_categories ON ratings.rating_category_id=rating_categories.id
-			WHERE tickets.created_at BETWEEN $4 AND $5
-			GROUP BY name
-			ORDER BY rating_categories.id ASC) ON id = id_2
-		GROUP BY name;`,
-		db.MaxRating, firstFrom.Format(db.SimpleDateFormat), firstTo.Format(db.SimpleDateFormat),
+	err := sqlite.stmts.Select("PeriodOverPeriod", &out,
+		db.MaxRating, firstFrom.Format(db.SimpleDateFormat), firstTo.Format(db.SimpleDateFormat), tenant,
 		secondFrom.Format(db.SimpleDateFormat), secondTo.Format(db.SimpleDateFormat))
 
 	if err != nil {
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+const DefaultBatchSize = 500
+
+// Row data copied between the databases, by table
+type table struct {
+	name  string
+	maxID func(ids db.MaxIDs) int32
+	// Copies the rows after the ID and returns the last copied ID and the number of rows
+	copy func(src, dst db.ServiceDB, afterID int32, limit int) (int32, int, error)
+	// Rows after the ID in the checksum format
+	lines func(svcDB db.ServiceDB, afterID int32, limit int) (int32, []string, error)
+}
+
+// In the order the tables reference each other
+var tables = []table{
+	{
+		name:  "rating_categories",
+		maxID: func(ids db.MaxIDs) int32 { return ids.Categories },
+		copy: func(src, dst db.ServiceDB, afterID int32, limit int) (int32, int, error) {
+			rows, err := src.ExportCategories(afterID, limit)
+			if err != nil || len(rows) == 0 {
+				return afterID, 0, err
+			}
+			return rows[len(rows)-1].ID, len(rows), dst.ImportCategories(rows)
+		},
+		lines: func(svcDB db.ServiceDB, afterID int32, limit int) (int32, []string, error) {
+			rows, err := svcDB.ExportCategories(afterID, limit)
+			lines := make([]string, len(rows))
+			for i, row := range rows {
+				lines[i] = fmt.Sprintf("%d|%s|%s|%s", row.ID, row.Tenant, row.Name,
+					strconv.FormatFloat(row.Weight, 'g', -1, 64))
+				afterID = row.ID
+			}
+			return afterID, lines, err
+		},
+	},
+	{
+		name:  "tickets",
+		maxID: func(ids db.MaxIDs) int32 { return ids.Tickets },
+		copy: func(src, dst db.ServiceDB, afterID int32, limit int) (int32, int, error) {
+			rows, err := src.ExportTickets(afterID, limit)
+			if err != nil || len(rows) == 0 {
+				return afterID, 0, err
+			}
+			return rows[len(rows)-1].ID, len(rows), dst.ImportTickets(rows)
+		},
+		lines: func(svcDB db.ServiceDB, afterID int32, limit int) (int32, []string, error) {
+			rows, err := svcDB.ExportTickets(afterID, limit)
+			lines := make([]string, len(rows))
+			for i, row := range rows {
+				lines[i] = fmt.Sprintf("%d|%s|%s|%s", row.ID, row.Tenant, row.Subject, formatTime(row.CreatedAt))
+				afterID = row.ID
+			}
+			return afterID, lines, err
+		},
+	},
+	{
+		name:  "ratings",
+		maxID: func(ids db.MaxIDs) int32 { return ids.Ratings },
+		copy: func(src, dst db.ServiceDB, afterID int32, limit int) (int32, int, error) {
+			rows, err := src.ExportRatings(afterID, limit)
+			if err != nil || len(rows) == 0 {
+				return afterID, 0, err
+			}
+			return rows[len(rows)-1].ID, len(rows), dst.ImportRatings(rows)
+		},
+		lines: func(svcDB db.ServiceDB, afterID int32, limit int) (int32, []string, error) {
+			rows, err := svcDB.ExportRatings(afterID, limit)
+			lines := make([]string, len(rows))
+			for i, row := range rows {
+				rating := "null"
+				if row.Rating.Valid {
+					rating = strconv.Itoa(int(row.Rating.Int32))
+				}
+				lines[i] = fmt.Sprintf("%d|%s|%s|%d|%d|%d|%d|%s", row.ID, row.Tenant, rating, row.TicketID,
+					row.CategoryID, row.ReviewerID, row.RevieweeID, formatTime(row.CreatedAt))
+				afterID = row.ID
+			}
+			return afterID, lines, err
+		},
+	},
+}
+
+// Databases store times with different precision and time zones
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+/*
+Copy copies rating categories, tickets and ratings of all the tenants from src to dst
+in batches of batchSize rows, each batch in its own transaction. Tables are copied in ID order
+starting after the highest ID in dst, so a failed copy continues where it stopped when run again.
+The dst daily rollup is rebuilt after copying.
+*/
+func Copy(logger *zap.Logger, src, dst db.ServiceDB, batchSize int) error {
+	srcIDs, err := src.MaxIDs()
+	if err != nil {
+		return errors.Wrap(err, "failed to read source IDs")
+	}
+	dstIDs, err := dst.MaxIDs()
+	if err != nil {
+		return errors.Wrap(err, "failed to read destination IDs")
+	}
+
+	for _, t := range tables {
+		log := logger.With(zap.String("table", t.name), zap.Int32("max_id", t.maxID(srcIDs)))
+		afterID := t.maxID(dstIDs)
+		if afterID > 0 {
+			log.Info("resuming copy", zap.Int32("after_id", afterID))
+		}
+
+		copied := 0
+		for {
+			lastID, n, err := t.copy(src, dst, afterID, batchSize)
+			if err != nil {
+				return errors.Wrapf(err, "failed to copy %s after ID %d", t.name, afterID)
+			}
+			if n == 0 {
+				break
+			}
+			copied += n
+			afterID = lastID
+			log.Info("copied rows", zap.Int("rows", copied), zap.Int32("last_id", afterID))
+		}
+		log.Info("table copied", zap.Int("rows", copied))
+	}
+
+	if err := dst.RebuildRollup(); err != nil {
+		return errors.Wrap(err, "failed to rebuild daily rollup")
+	}
+	return nil
+}
+
+type Summary struct {
+	Table    string
+	Rows     int
+	Checksum string
+}
+
+// Row count and SHA-256 checksum of every table, reading batchSize rows at a time
+func Checksums(svcDB db.ServiceDB, batchSize int) ([]Summary, error) {
+	out := []Summary{}
+	for _, t := range tables {
+		h := sha256.New()
+		rows := 0
+		afterID := int32(0)
+		for {
+			lastID, lines, err := t.lines(svcDB, afterID, batchSize)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", t.name)
+			}
+			if len(lines) == 0 {
+				break
+			}
+			for _, line := range lines {
+				fmt.Fprintln(h, line)
+			}
+			rows += len(lines)
+			afterID = lastID
+		}
+		out = append(out, Summary{Table: t.name, Rows: rows, Checksum: hex.EncodeToString(h.Sum(nil))})
+	}
+	return out, nil
+}
+
+// Compares row counts and checksums of the databases
+func Verify(logger *zap.Logger, src, dst db.ServiceDB, batchSize int) error {
+	srcSums, err := Checksums(src, batchSize)
+	if err != nil {
+		return errors.Wrap(err, "source")
+	}
+	dstSums, err := Checksums(dst, batchSize)
+	if err != nil {
+		return errors.Wrap(err, "destination")
+	}
+
+	failed := []string{}
+	for i, s := range srcSums {
+		d := dstSums[i]
+		logger.Info("verified table",
+			zap.String("table", s.Table),
+			zap.Int("source_rows", s.Rows),
+			zap.Int("destination_rows", d.Rows),
+			zap.String("source_checksum", s.Checksum),
+			zap.String("destination_checksum", d.Checksum))
+		if s.Rows != d.Rows || s.Checksum != d.Checksum {
+			failed = append(failed, s.Table)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("data differs in %v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/internal/db/sqlite"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Demo fixture of the service tests, IDs have gaps and tenant acme has its own rows
+func newSource(t *testing.T) *memory.MemoryDB {
+	t.Helper()
+	src, err := memory.NewFromFile("../../service/testdata/demo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func newDestination(t *testing.T) *sqlite.SQLiteDB {
+	t.Helper()
+	dst, err := sqlite.New(filepath.Join(t.TempDir(), "dst.db"), db.Pool{MaxIdleConns: db.DefaultMaxIdleConns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(dst.Close)
+
+	migrator, err := dst.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := newSource(t), newDestination(t)
+	// Batches smaller than the tables
+	if err := Copy(zap.NewNop(), src, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	srcSums, err := Checksums(src, DefaultBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstSums, err := Checksums(dst, DefaultBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Summary{{Table: "rating_categories", Rows: 3}, {Table: "tickets", Rows: 4}, {Table: "ratings", Rows: 7}}
+	for i, sum := range dstSums {
+		if sum.Table != want[i].Table || sum.Rows != want[i].Rows {
+			t.Fatalf("got %s with %d rows, want %s with %d", sum.Table, sum.Rows, want[i].Table, want[i].Rows)
+		}
+		// Checksum lines start with the row ID
+		if sum.Checksum != srcSums[i].Checksum {
+			t.Fatalf("%s checksum differs", sum.Table)
+		}
+	}
+	if err := Verify(zap.NewNop(), src, dst, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := dst.MaxIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids != (db.MaxIDs{Categories: 3, Tickets: 10, Ratings: 20}) {
+		t.Fatalf("got max IDs %+v", ids)
+	}
+
+	// Whole days are read from the rollup, which is empty unless rebuilt
+	from, to := time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2019, 3, 18, 0, 0, 0, 0, time.UTC)
+	for _, tenant := range []string{"default", "acme"} {
+		srcScores, err := src.DailyScores(tenant, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstScores, err := dst.DailyScores(tenant, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dstScores) == 0 || !reflect.DeepEqual(scoreValues(dstScores), scoreValues(srcScores)) {
+			t.Fatalf("got daily scores %v for %s, want %v", dstScores, tenant, srcScores)
+		}
+	}
+
+	// New rows continue after the copied IDs
+	id, err := dst.AddTicket("default", &pb.Ticket{Subject: "After copy", Ratings: []*pb.Rating{{CategoryId: 1, Rating: 5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= 10 {
+		t.Fatalf("got ticket ID %d, want after the copied tickets", id)
+	}
+}
+
+func TestCopyResumes(t *testing.T) {
+	src, dst := newSource(t), newDestination(t)
+
+	// Destination already has the first rows, as after an interrupted copy
+	categories, err := src.ExportCategories(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.ImportCategories(categories); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Copy(zap.NewNop(), src, dst, DefaultBatchSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Verify(zap.NewNop(), src, dst, DefaultBatchSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type scoreValue struct {
+	period, category string
+	score            int32
+}
+
+func scoreValues(scores []*pb.PeriodScore) []scoreValue {
+	out := []scoreValue{}
+	for _, s := range scores {
+		out = append(out, scoreValue{period: s.Period, category: s.Category, score: s.Score})
+	}
+	return out
+}
@@ -0,0 +1,343 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Rows are flushed to the client after this many rows
+const flushRows = 1000
+
+// Writes the export rows as they are read from the database
+type rowWriter interface {
+	Write(values ...interface{}) error
+	// Sends the buffered rows to the client
+	Flush() error
+}
+
+// Tells whether any of the response was sent, after which errors can not change the status
+type response struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (r *response) Write(b []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *response) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type export struct {
+	// gRPC method serving the same data, its authorization policy applies to the export
+	method  string
+	columns []string
+	// Index of the category column, callers restricted to some categories can not read exports without one
+	category int
+	query    func(svcDB db.ServiceDB, req *http.Request, tenant string, from, to time.Time, w rowWriter) error
+}
+
+var exports = map[string]export{
+	"ticket-scores":   ticketScores,
+	"category-scores": categoryScores,
+	"rating-counts":   ratingCounts,
+	"overall-score":   overallScore,
+}
+
+/*
+Handler serves database query results of the caller's tenant as CSV or NDJSON.
+Supported query parameters:
+
+	from, to  period dates in YYYY-MM-DD format (required)
+	format    "csv" (default) or "ndjson"
+*/
+func Handler(logger *zap.Logger, svcDB db.ServiceDB) http.Handler {
+	mux := http.NewServeMux()
+	for name, e := range exports {
+		mux.Handle("/export/"+name, handler(logger, svcDB, name, e))
+	}
+	return mux
+}
+
+// gRPC methods whose authorization applies to the export request, none for unknown exports
+func Methods(req *http.Request) []string {
+	e, ok := exports[strings.TrimPrefix(req.URL.Path, "/export/")]
+	if !ok {
+		return nil
+	}
+	return []string{e.method}
+}
+
+func handler(logger *zap.Logger, svcDB db.ServiceDB, name string, e export) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		from, err := parseDate(req, "from")
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseDate(req, "to")
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if from.After(to) {
+			http.Error(res, "from must not be after to", http.StatusBadRequest)
+			return
+		}
+
+		format := strings.ToLower(req.URL.Query().Get("format"))
+		if format == "" {
+			format = FormatCSV
+		}
+		if format != FormatCSV && format != FormatNDJSON {
+			http.Error(res, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		allowed, restricted := auth.AllowedCategories(req.Context())
+		if restricted && e.category < 0 {
+			http.Error(res, "export is not available with category restrictions", http.StatusForbidden)
+			return
+		}
+
+		tenant := auth.Tenant(req.Context())
+		logger.Info("export",
+			zap.String("tenant", tenant),
+			zap.String("name", name),
+			zap.String("format", format),
+			zap.String("from", from.Format(time.RFC3339)),
+			zap.String("to", to.Format(time.RFC3339)),
+		)
+
+		fileName := fmt.Sprintf("%s_%s_%s.%s",
+			name, from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), format)
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+		out := &response{ResponseWriter: res}
+		var w rowWriter
+		if format == FormatNDJSON {
+			res.Header().Set("Content-Type", "application/x-ndjson")
+			w = newNDJSONWriter(out, e.columns)
+		} else {
+			res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w = newCSVWriter(out, e.columns)
+		}
+		if restricted {
+			w = &categoryFilter{rowWriter: w, column: e.category, allowed: allowed}
+		}
+
+		err = e.query(svcDB, req, tenant, from, to, w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil && !out.started {
+			logger.Error("DB error", zap.Error(err))
+			res.Header().Del("Content-Disposition")
+			http.Error(res, "failed to read data from the database", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			// Status is already sent, the client gets a truncated file
+			logger.Warn("export failed", zap.String("name", name), zap.Error(err))
+		}
+	})
+}
+
+func parseDate(req *http.Request, param string) (time.Time, error) {
+	value := req.URL.Query().Get(param)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("%s query parameter is required", param)
+	}
+	t, err := time.Parse(db.SimpleDateFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be in YYYY-MM-DD format", param)
+	}
+	return t, nil
+}
+
+// Header is written with the first row, so an error before any rows can still be reported
+type csvWriter struct {
+	out     *response
+	w       *csv.Writer
+	columns []string
+	record  []string
+	rows    int
+}
+
+func newCSVWriter(out *response, columns []string) *csvWriter {
+	return &csvWriter{
+		out:     out,
+		w:       csv.NewWriter(out),
+		columns: columns,
+		record:  make([]string, len(columns)),
+	}
+}
+
+func (c *csvWriter) Write(values ...interface{}) error {
+	if c.rows == 0 {
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	for i, value := range values {
+		c.record[i] = fmt.Sprint(value)
+	}
+	if err := c.w.Write(c.record); err != nil {
+		return err
+	}
+	c.rows++
+	if c.rows%flushRows == 0 {
+		return c.Flush()
+	}
+	return nil
+}
+
+func (c *csvWriter) Flush() error {
+	if c.rows == 0 && !c.out.started {
+		// Empty export still has the header
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	c.out.Flush()
+	return nil
+}
+
+type ndjsonWriter struct {
+	out     *response
+	enc     *json.Encoder
+	columns []string
+	rows    int
+}
+
+func newNDJSONWriter(out *response, columns []string) *ndjsonWriter {
+	return &ndjsonWriter{out: out, enc: json.NewEncoder(out), columns: columns}
+}
+
+func (n *ndjsonWriter) Write(values ...interface{}) error {
+	item := make(map[string]interface{}, len(n.columns))
+	for i, value := range values {
+		item[n.columns[i]] = value
+	}
+	if err := n.enc.Encode(item); err != nil {
+		return err
+	}
+	n.rows++
+	if n.rows%flushRows == 0 {
+		return n.Flush()
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) Flush() error {
+	n.out.Flush()
+	return nil
+}
+
+// Drops the rows of categories the caller is not allowed to see
+type categoryFilter struct {
+	rowWriter
+	column  int
+	allowed map[string]bool
+}
+
+func (f *categoryFilter) Write(values ...interface{}) error {
+	if category, _ := values[f.column].(string); !f.allowed[category] {
+		return nil
+	}
+	return f.rowWriter.Write(values...)
+}
+
+var ticketScores = export{
+	method:   "/grpc.sample.TicketService/TicketScores",
+	columns:  []string{"ticket_id", "category", "score"},
+	category: 1,
+	query: func(svcDB db.ServiceDB, req *http.Request, tenant string, from, to time.Time, w rowWriter) error {
+		return db.EachTicketScore(svcDB, tenant, from, to, func(score *pb.TicketScore) error {
+			return w.Write(score.Id, score.Category, score.Score)
+		})
+	},
+}
+
+// Daily scores by default. Weekly scores with "period=week" query parameter.
+var categoryScores = export{
+	method:   "/grpc.sample.TicketService/CategoryScores",
+	columns:  []string{"period", "category_id", "category", "score"},
+	category: 2,
+	query: func(svcDB db.ServiceDB, req *http.Request, tenant string, from, to time.Time, w rowWriter) error {
+		scoresFunc := svcDB.DailyScores
+		if req.URL.Query().Get("period") == "week" {
+			scoresFunc = svcDB.WeeklyScores
+		}
+
+		scores, err := scoresFunc(tenant, from, to)
+		if err != nil {
+			return err
+		}
+		for _, score := range scores {
+			if err := w.Write(score.Period, score.Id, score.Category, score.Score); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var ratingCounts = export{
+	method:   "/grpc.sample.TicketService/CategoryScores",
+	columns:  []string{"category_id", "category", "count"},
+	category: 1,
+	query: func(svcDB db.ServiceDB, req *http.Request, tenant string, from, to time.Time, w rowWriter) error {
+		counts, err := svcDB.RatingCounts(tenant, from, to)
+		if err != nil {
+			return err
+		}
+		for _, count := range counts {
+			if err := w.Write(count.Id, count.Name, count.Count); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var overallScore = export{
+	method:   "/grpc.sample.TicketService/OveralScore",
+	columns:  []string{"from", "to", "score"},
+	category: -1,
+	query: func(svcDB db.ServiceDB, req *http.Request, tenant string, from, to time.Time, w rowWriter) error {
+		score, err := svcDB.OveralScore(tenant, from, to)
+		if err != nil {
+			return err
+		}
+		return w.Write(from.Format(db.SimpleDateFormat), to.Format(db.SimpleDateFormat), score)
+	},
+}
@@ -0,0 +1,201 @@
+package export
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Same fixture as the service tests
+const fixture = "../service/testdata/demo.json"
+
+func newTestDB(t *testing.T) *memory.MemoryDB {
+	t.Helper()
+	svcDB, err := memory.NewFromFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svcDB
+}
+
+// Policy where the analyst sees only Spelling
+const testPolicy = `
+roles:
+  viewer:
+    methods: ["*"]
+  analyst:
+    methods: ["*"]
+    categories: [Spelling]
+`
+
+func serve(t *testing.T, handler http.Handler, path, role, tenant string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{Subject: "test", Roles: []string{role}, Tenant: tenant}))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+func newTestHandler(t *testing.T, svcDB *memory.MemoryDB) http.Handler {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := auth.LoadPolicy(zap.NewNop(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy.HTTPHandler(Methods, Handler(zap.NewNop(), svcDB))
+}
+
+func TestExport(t *testing.T) {
+	handler := newTestHandler(t, newTestDB(t))
+
+	tests := []struct {
+		name        string
+		path        string
+		role        string
+		tenant      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{
+			name: "ticket scores as CSV", path: "/export/ticket-scores?from=2019-03-04&to=2019-03-06",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "ticket_id,category,score\n1,Spelling,100\n1,Grammar,60\n2,Spelling,80\n2,Grammar,20\n",
+		},
+		{
+			name: "ticket scores as NDJSON", path: "/export/ticket-scores?from=2019-03-04&to=2019-03-06&format=ndjson",
+			code: http.StatusOK, contentType: "application/x-ndjson",
+			body: `{"category":"Spelling","score":100,"ticket_id":1}` + "\n" +
+				`{"category":"Grammar","score":60,"ticket_id":1}` + "\n" +
+				`{"category":"Spelling","score":80,"ticket_id":2}` + "\n" +
+				`{"category":"Grammar","score":20,"ticket_id":2}` + "\n",
+		},
+		{
+			name: "daily category scores", path: "/export/category-scores?from=2019-03-04&to=2019-03-05",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "period,category_id,category,score\n2019-03-04,1,Spelling,100\n2019-03-04,2,Grammar,60\n",
+		},
+		{
+			name: "rating counts as NDJSON", path: "/export/rating-counts?from=2019-03-04&to=2019-03-06&format=NDJSON",
+			code: http.StatusOK, contentType: "application/x-ndjson",
+			body: `{"category":"Spelling","category_id":1,"count":2}` + "\n" +
+				`{"category":"Grammar","category_id":2,"count":2}` + "\n",
+		},
+		{
+			name: "overall score", path: "/export/overall-score?from=2019-03-04&to=2019-03-06",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "from,to,score\n2019-03-04,2019-03-06,69\n",
+		},
+		{
+			name: "empty export has the header", path: "/export/ticket-scores?from=2020-01-01&to=2020-01-02",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "ticket_id,category,score\n",
+		},
+		{
+			name: "tenant scoped", path: "/export/ticket-scores?from=2019-03-04&to=2019-03-06", tenant: "acme",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "ticket_id,category,score\n10,Spelling,20\n",
+		},
+		{
+			name: "categories filtered", path: "/export/ticket-scores?from=2019-03-04&to=2019-03-06", role: "analyst",
+			code: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			body: "ticket_id,category,score\n1,Spelling,100\n2,Spelling,80\n",
+		},
+		{
+			name: "export without categories is restricted", path: "/export/overall-score?from=2019-03-04&to=2019-03-06", role: "analyst",
+			code: http.StatusForbidden,
+		},
+		{name: "missing from", path: "/export/ticket-scores?to=2019-03-06", code: http.StatusBadRequest},
+		{name: "invalid date", path: "/export/ticket-scores?from=2019-03-04T00:00:00Z&to=2019-03-06", code: http.StatusBadRequest},
+		{name: "from after to", path: "/export/ticket-scores?from=2019-03-06&to=2019-03-04", code: http.StatusBadRequest},
+		{name: "unsupported format", path: "/export/ticket-scores?from=2019-03-04&to=2019-03-06&format=xml", code: http.StatusBadRequest},
+		// Policy denies paths without methods
+		{name: "unknown export", path: "/export/ratings?from=2019-03-04&to=2019-03-06", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := tt.role
+			if role == "" {
+				role = "viewer"
+			}
+			res := serve(t, handler, tt.path, role, tt.tenant)
+			if res.Code != tt.code {
+				t.Fatalf("got status %d (%s), want %d", res.Code, res.Body.String(), tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if got := res.Header().Get("Content-Type"); got != tt.contentType {
+				t.Fatalf("got content type %q, want %q", got, tt.contentType)
+			}
+			if got := res.Body.String(); got != tt.body {
+				t.Fatalf("got body\n%s\nwant\n%s", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestExportFileName(t *testing.T) {
+	res := serve(t, newTestHandler(t, newTestDB(t)), "/export/rating-counts?from=2019-03-04&to=2019-03-06&format=ndjson", "viewer", "")
+	if got, want := res.Header().Get("Content-Disposition"), `attachment; filename="rating-counts_2019-03-04_2019-03-06.ndjson"`; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+var errStream = errors.New("connection lost")
+
+// Streams the given number of ticket scores and fails
+type failingDB struct {
+	*memory.MemoryDB
+	rows int
+}
+
+func (d *failingDB) EachTicketScore(tenant string, from, to time.Time, fn func(score *pb.TicketScore) error) error {
+	for i := 0; i < d.rows; i++ {
+		if err := fn(&pb.TicketScore{Id: int32(i + 1), Category: "Spelling", Score: 100}); err != nil {
+			return err
+		}
+	}
+	return errStream
+}
+
+func TestExportStreamError(t *testing.T) {
+	const path = "/export/ticket-scores?from=2019-03-04&to=2019-03-06"
+
+	// Nothing is sent before the first flush, so the error is still reported
+	res := httptest.NewRecorder()
+	Handler(zap.NewNop(), &failingDB{MemoryDB: newTestDB(t), rows: 1}).ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusInternalServerError || res.Header().Get("Content-Disposition") != "" {
+		t.Fatalf("got status %d with headers %v, want 500 without the attachment", res.Code, res.Header())
+	}
+
+	// After the header and first rows are flushed the client gets a truncated file
+	res = httptest.NewRecorder()
+	Handler(zap.NewNop(), &failingDB{MemoryDB: newTestDB(t), rows: flushRows + 1}).ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.Code)
+	}
+	lines := strings.Split(strings.TrimSuffix(res.Body.String(), "\n"), "\n")
+	if lines[0] != "ticket_id,category,score" || len(lines) != flushRows+1 {
+		t.Fatalf("got %d lines starting with %q, want the header and %d rows", len(lines), lines[0], flushRows)
+	}
+	if strings.Contains(res.Body.String(), "failed to read data") {
+		t.Fatal("error message was written into the export")
+	}
+}
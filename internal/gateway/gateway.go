@@ -0,0 +1,321 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const (
+	// URL prefix for the gateway endpoints
+	Prefix = "/v1/"
+
+	// HTTP headers with this prefix are forwarded as gRPC metadata
+	metadataHeaderPrefix = "Grpc-Metadata-"
+
+	bufferSize  = 1024 * 1024
+	maxBodySize = 1024 * 1024
+)
+
+/*
+Gateway exposes gRPC service methods as JSON HTTP endpoints.
+Requests are sent to the in-process gRPC server through an in-memory
+listener so they go through the same interceptors and validation as native gRPC calls.
+
+Every unary method of the service is available as
+
+	POST /v1/{Service}/{Method} with the request message as JSON body
+	GET  /v1/{Service}/{Method}?field=value&nested.field=value
+*/
+func New(logger *zap.Logger) (*Gateway, error) {
+	listener := bufconn.Listen(bufferSize)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial in-memory listener")
+	}
+
+	return &Gateway{
+		log:      logger,
+		listener: listener,
+		conn:     conn,
+		methods:  map[string]protoreflect.MethodDescriptor{},
+	}, nil
+}
+
+type Gateway struct {
+	log      *zap.Logger
+	listener *bufconn.Listener
+	conn     *grpc.ClientConn
+	methods  map[string]protoreflect.MethodDescriptor
+}
+
+// Listener the gRPC server must serve for the gateway to reach it
+func (gw *Gateway) Listener() net.Listener {
+	return gw.listener
+}
+
+// Exposes all unary methods of the service with the given name from service.proto
+func (gw *Gateway) Register(serviceName protoreflect.Name) error {
+	service := pb.File_pb_service_proto.Services().ByName(serviceName)
+	if service == nil {
+		return errors.Errorf("service %s not found", serviceName)
+	}
+
+	methods := service.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		method := methods.Get(i)
+		if method.IsStreamingClient() || method.IsStreamingServer() {
+			continue
+		}
+		gw.methods[string(service.Name())+"/"+string(method.Name())] = method
+	}
+	return nil
+}
+
+func (gw *Gateway) Close() {
+	gw.conn.Close()
+}
+
+func (gw *Gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	method, ok := gw.methods[strings.TrimPrefix(req.URL.Path, Prefix)]
+	if !ok {
+		gw.writeError(res, status.Error(codes.NotFound, "unknown method"))
+		return
+	}
+
+	in, err := newMessage(method.Input())
+	if err != nil {
+		gw.writeError(res, err)
+		return
+	}
+	out, err := newMessage(method.Output())
+	if err != nil {
+		gw.writeError(res, err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		err = decodeBody(res, req, in)
+	case http.MethodGet:
+		err = decodeQuery(req, in)
+	default:
+		res.Header().Set("Allow", "GET, POST")
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		gw.writeError(res, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	fullMethod := "/" + string(method.Parent().FullName()) + "/" + string(method.Name())
+	ctx := metadata.NewOutgoingContext(req.Context(), incomingMetadata(req))
+	if err := gw.conn.Invoke(ctx, fullMethod, in, out); err != nil {
+		gw.writeError(res, err)
+		return
+	}
+
+	b, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(out)
+	if err != nil {
+		gw.writeError(res, err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(b)
+}
+
+func newMessage(desc protoreflect.MessageDescriptor) (proto.Message, error) {
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		return nil, errors.Wrapf(err, "message type %s", desc.FullName())
+	}
+	return msgType.New().Interface(), nil
+}
+
+func decodeBody(res http.ResponseWriter, req *http.Request, in proto.Message) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxBodySize))
+	if err != nil {
+		return errors.Wrap(err, "failed to read request body")
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return protojson.Unmarshal(body, in)
+}
+
+// Query parameters are mapped to message fields. Nested fields are separated with dots.
+func decodeQuery(req *http.Request, in proto.Message) error {
+	fields := map[string]interface{}{}
+	for key, values := range req.URL.Query() {
+		path := strings.Split(key, ".")
+		node := fields
+		for _, name := range path[:len(path)-1] {
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[name] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = values[len(values)-1]
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(b, in)
+}
+
+// Authorization, X-Api-Key and Grpc-Metadata-* headers get passed on to the gRPC server
+func incomingMetadata(req *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range req.Header {
+		switch {
+		case key == "Authorization":
+			md.Append("authorization", values...)
+		case key == "X-Api-Key":
+			md.Append("x-api-key", values...)
+		case strings.HasPrefix(key, metadataHeaderPrefix):
+			md.Append(strings.TrimPrefix(key, metadataHeaderPrefix), values...)
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		md.Append("x-forwarded-for", host)
+	}
+	return md
+}
+
+type errorBody struct {
+	Code    int32  `json:"code"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (gw *Gateway) writeError(res http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	if st.Code() == codes.Unknown || st.Code() == codes.Internal {
+		gw.log.Warn("gateway call failed", zap.Error(err))
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := math.Ceil(info.RetryDelay.AsDuration().Seconds())
+			res.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+		}
+	}
+	res.WriteHeader(HTTPStatusFromCode(st.Code()))
+	_ = json.NewEncoder(res).Encode(errorBody{
+		Code:    int32(st.Code()),
+		Error:   st.Code().String(),
+		Message: st.Message(),
+	})
+}
+
+// Maps gRPC status code to HTTP status the same way grpc-gateway does
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+/*
+Wraps gRPC server credentials so connections from the gateway in-memory listener
+skip the transport handshake. Other connections use the wrapped credentials.
+*/
+func (gw *Gateway) ServerCredentials(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return &serverCredentials{TransportCredentials: creds}
+}
+
+type serverCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c *serverCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if conn.LocalAddr().Network() == "bufconn" {
+		return conn, AuthInfo{}, nil
+	}
+	return c.TransportCredentials.ServerHandshake(conn)
+}
+
+func (c *serverCredentials) Clone() credentials.TransportCredentials {
+	return &serverCredentials{TransportCredentials: c.TransportCredentials.Clone()}
+}
+
+// Peer auth info for calls made through the gateway
+type AuthInfo struct{}
+
+func (AuthInfo) AuthType() string {
+	return "gateway"
+}
+
+/*
+Returns the HTTP client address for calls made through the gateway.
+The address is the last "x-forwarded-for" value, which is set by the gateway itself.
+*/
+func ClientAddr(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil || p.Addr.Network() != "bufconn" {
+		return "", false
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("x-forwarded-for")
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
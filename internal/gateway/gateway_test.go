@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestHTTPStatusFromCode(t *testing.T) {
+	tests := map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.Aborted:            http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.DataLoss:           http.StatusInternalServerError,
+	}
+	for code, want := range tests {
+		if got := HTTPStatusFromCode(code); got != want {
+			t.Errorf("%s: got %d, want %d", code, got, want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	gw := &Gateway{log: zap.NewNop()}
+	st, err := status.New(codes.ResourceExhausted, "rate limit exceeded").
+		WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(1500 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	gw.writeError(res, st.Err())
+
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "2" {
+		t.Fatalf("got status %d with Retry-After %q, want 429 with 2", res.Code, res.Header().Get("Retry-After"))
+	}
+	body := errorBody{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body != (errorBody{Code: int32(codes.ResourceExhausted), Error: "ResourceExhausted", Message: "rate limit exceeded"}) {
+		t.Fatalf("got body %+v", body)
+	}
+}
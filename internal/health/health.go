@@ -0,0 +1,170 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+const (
+	// Service name reported in addition to the overall server status
+	TicketService = "grpc.sample.TicketService"
+
+	pingTimeout = 5 * time.Second
+)
+
+func NewChecker(logger *zap.Logger, svcDB db.ServiceDB) *Checker {
+	server := health.NewServer()
+	// Not serving until the first successful probe
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	server.SetServingStatus(TicketService, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	return &Checker{
+		log:    logger,
+		db:     svcDB,
+		server: server,
+	}
+}
+
+/*
+Checker probes the database periodically and reports the result through the gRPC health service.
+Both the overall status and TicketService status follow the database availability.
+*/
+type Checker struct {
+	log    *zap.Logger
+	db     db.ServiceDB
+	server *health.Server
+
+	mu       sync.Mutex
+	dbErr    error
+	probed   bool
+	shutdown bool
+	checks   []readinessCheck
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Adds a check that must pass for the service to be ready
+func (c *Checker) AddReadinessCheck(name string, check func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, readinessCheck{name: name, check: check})
+}
+
+// gRPC health server to register with the gRPC server
+func (c *Checker) Server() grpc_health_v1.HealthServer {
+	return c.server
+}
+
+// Probes the database every interval until the context is cancelled
+func (c *Checker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.Probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) Probe(ctx context.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	err := c.db.Ping(pingCtx)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shutdown {
+		return
+	}
+
+	if c.probed && (err == nil) == (c.dbErr == nil) {
+		c.dbErr = err
+		return
+	}
+	c.probed = true
+	c.dbErr = err
+
+	status := grpc_health_v1.HealthCheckResponse_SERVING
+	if err != nil {
+		status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		c.log.Error("database health check failed", zap.Error(err))
+	} else {
+		c.log.Info("database health check passed")
+	}
+	c.server.SetServingStatus("", status)
+	c.server.SetServingStatus(TicketService, status)
+}
+
+/*
+Returns nil when the service can take traffic: the last database probe succeeded,
+all the readiness checks pass and the service is not shutting down.
+*/
+func (c *Checker) Ready(ctx context.Context) error {
+	c.mu.Lock()
+	shutdown, probed, dbErr := c.shutdown, c.probed, c.dbErr
+	checks := c.checks
+	c.mu.Unlock()
+
+	switch {
+	case shutdown:
+		return errors.New("shutting down")
+	case !probed:
+		return errors.New("database has not been checked yet")
+	case dbErr != nil:
+		return errors.Wrap(dbErr, "database unavailable")
+	}
+
+	for _, check := range checks {
+		if err := check.check(ctx); err != nil {
+			return errors.Wrap(err, check.name)
+		}
+	}
+	return nil
+}
+
+// Liveness endpoint. Responds OK as long as the process is able to serve HTTP.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte("ok\n"))
+	})
+}
+
+// Readiness endpoint. Responds with 503 and the reason when the service is not ready.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := c.Ready(req.Context()); err != nil {
+			http.Error(res, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = res.Write([]byte("ok\n"))
+	})
+}
+
+/*
+Sets all the services to NOT_SERVING and ignores further probe results.
+Should be called before the gRPC server is stopped so clients can move away.
+*/
+func (c *Checker) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdown = true
+	c.server.Shutdown()
+}
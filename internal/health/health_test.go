@@ -0,0 +1,199 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+)
+
+// Fails the given number of pings and succeeds after that
+type pinger struct {
+	*memory.MemoryDB
+
+	mu       sync.Mutex
+	failures int
+	pings    int
+}
+
+func (p *pinger) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings++
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (p *pinger) fail(times int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = times
+}
+
+func newTestChecker(failures int) (*Checker, *pinger) {
+	p := &pinger{MemoryDB: memory.New(), failures: failures}
+	return NewChecker(zap.NewNop(), p), p
+}
+
+// Health client connected to the checker's server over an in-memory listener
+func newHealthClient(t *testing.T, c *Checker) grpc_health_v1.HealthClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, c.Server())
+	go func() { _ = server.Serve(listener) }()
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return grpc_health_v1.NewHealthClient(conn)
+}
+
+func get(handler http.Handler) (int, string) {
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	return res.Code, res.Body.String()
+}
+
+func TestWatchFollowsProbes(t *testing.T) {
+	c, p := newTestChecker(0)
+	client := newHealthClient(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: TicketService})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(want grpc_health_v1.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Fatalf("got %s, want %s", resp.Status, want)
+		}
+	}
+
+	// Not serving before the first probe
+	next(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	c.Probe(ctx)
+	next(grpc_health_v1.HealthCheckResponse_SERVING)
+
+	p.fail(2)
+	c.Probe(ctx)
+	next(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	// Repeated failure does not change the status
+	c.Probe(ctx)
+	c.Probe(ctx)
+	next(grpc_health_v1.HealthCheckResponse_SERVING)
+
+	c.Shutdown()
+	next(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	c.Probe(ctx)
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("got %s after shutdown, want NOT_SERVING", resp.Status)
+	}
+}
+
+func TestRunProbesUntilRecovered(t *testing.T) {
+	c, p := newTestChecker(3)
+	client := newHealthClient(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		c.Run(runCtx, time.Millisecond)
+		close(done)
+	}()
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == grpc_health_v1.HealthCheckResponse_SERVING {
+			break
+		}
+	}
+	stop()
+	<-done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pings < 4 {
+		t.Fatalf("got serving after %d pings, want at least 4", p.pings)
+	}
+}
+
+func TestLivenessAndReadiness(t *testing.T) {
+	c, p := newTestChecker(1)
+	liveness, readiness := c.LivenessHandler(), c.ReadinessHandler()
+	ctx := context.Background()
+
+	var queueErr error
+	c.AddReadinessCheck("queue", func(ctx context.Context) error { return queueErr })
+
+	steps := []struct {
+		name      string
+		step      func()
+		readyCode int
+		reason    string
+	}{
+		{name: "not probed", step: func() {}, readyCode: http.StatusServiceUnavailable, reason: "not been checked"},
+		{name: "database down", step: func() { c.Probe(ctx) }, readyCode: http.StatusServiceUnavailable, reason: "database unavailable: connection refused"},
+		{name: "database recovered", step: func() { c.Probe(ctx) }, readyCode: http.StatusOK},
+		{name: "readiness check failing", step: func() { queueErr = errors.New("backlog") }, readyCode: http.StatusServiceUnavailable, reason: "queue: backlog"},
+		{name: "readiness check passing", step: func() { queueErr = nil }, readyCode: http.StatusOK},
+		{name: "database down again", step: func() { p.fail(1); c.Probe(ctx) }, readyCode: http.StatusServiceUnavailable, reason: "database unavailable"},
+		{name: "shutting down", step: func() { c.Probe(ctx); c.Shutdown() }, readyCode: http.StatusServiceUnavailable, reason: "shutting down"},
+	}
+	for _, s := range steps {
+		s.step()
+		// Liveness does not depend on the database or readiness
+		if code, _ := get(liveness); code != http.StatusOK {
+			t.Fatalf("%s: got liveness status %d, want 200", s.name, code)
+		}
+		code, body := get(readiness)
+		if code != s.readyCode || !strings.Contains(body, s.reason) {
+			t.Fatalf("%s: got readiness %d %q, want %d with %q", s.name, code, body, s.readyCode, s.reason)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/gateway"
+)
+
+const (
+	// Concurrency limit key that applies to every method without its own limit
+	AnyMethod = "*"
+
+	// Token buckets of clients idle for this long are removed
+	idleTimeout = 10 * time.Minute
+	// Suggested retry delay for calls rejected by the concurrency limit
+	concurrencyRetryDelay = time.Second
+)
+
+var (
+	rejectedCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_sample_limit_rejected_total",
+		Help: "Calls rejected by the rate or concurrency limits.",
+	}, []string{"grpc_method", "limit"})
+	callsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_sample_concurrent_calls",
+		Help: "Calls in progress for methods with a concurrency limit.",
+	}, []string{"grpc_method"})
+	concurrencyLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_sample_concurrency_limit",
+		Help: "Maximum concurrent calls by method. Method * applies to every other method.",
+	}, []string{"grpc_method"})
+	rateLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_sample_rate_limit",
+		Help: "Allowed calls per second per client. Zero when rate limiting is disabled.",
+	})
+	rateBurst = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_sample_rate_limit_burst",
+		Help: "Maximum burst of calls per client.",
+	})
+	rateClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_sample_rate_limit_clients",
+		Help: "Clients with an active token bucket.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rejectedCalls, callsInFlight, concurrencyLimit, rateLimit, rateBurst, rateClients)
+}
+
+/*
+Limiter rejects calls with ResourceExhausted when a client makes calls faster than
+the token bucket rate or when a method has too many calls in progress.
+Clients are identified by the authenticated principal, or by the peer address
+for unauthenticated calls. Calls through the REST gateway use the HTTP client address.
+Rate limiting is disabled when perSecond is 0.
+*/
+func New(logger *zap.Logger, perSecond float64, burst int, concurrency map[string]int) *Limiter {
+	l := &Limiter{
+		log:      logger,
+		now:      time.Now,
+		buckets:  map[string]*bucket{},
+		inFlight: map[string]int{},
+	}
+	l.Update(perSecond, burst, concurrency)
+	return l
+}
+
+type Limiter struct {
+	log *zap.Logger
+	now func() time.Time
+
+	mu          sync.Mutex
+	rate        rate.Limit
+	burst       int
+	buckets     map[string]*bucket
+	concurrency map[string]int
+	inFlight    map[string]int
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+/*
+Parses concurrency limits in "/package.Service/Method=N,*=N" format.
+Methods must exist in the registered protobuf services.
+*/
+func ParseConcurrency(spec string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid concurrency limit %q, expected method=limit", item)
+		}
+		method := strings.TrimSpace(parts[0])
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 1 {
+			return nil, errors.Errorf("invalid concurrency limit %q, limit must be a positive number", item)
+		}
+		if method != AnyMethod {
+			if err := validateMethod(method); err != nil {
+				return nil, err
+			}
+		}
+		limits[method] = limit
+	}
+	return limits, nil
+}
+
+func validateMethod(method string) error {
+	parts := strings.Split(method, "/")
+	if len(parts) != 3 || parts[0] != "" {
+		return errors.Errorf("invalid method %q, expected /package.Service/Method", method)
+	}
+
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(parts[1]))
+	if err != nil {
+		return errors.Errorf("unknown service in %q", method)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok || service.Methods().ByName(protoreflect.Name(parts[2])) == nil {
+		return errors.Errorf("unknown method %q", method)
+	}
+	return nil
+}
+
+/*
+Replaces the limits while the service is running.
+Token buckets start over with the new rate. Calls in progress are not interrupted.
+*/
+func (l *Limiter) Update(perSecond float64, burst int, concurrency map[string]int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	l.rate = rate.Limit(perSecond)
+	l.burst = burst
+	l.buckets = map[string]*bucket{}
+	l.concurrency = concurrency
+	l.mu.Unlock()
+
+	rateLimit.Set(perSecond)
+	rateBurst.Set(float64(burst))
+	rateClients.Set(0)
+	concurrencyLimit.Reset()
+	for method, limit := range concurrency {
+		concurrencyLimit.WithLabelValues(method).Set(float64(limit))
+	}
+}
+
+// Removes token buckets of idle clients until the context is cancelled
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(idleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.evict()
+		}
+	}
+}
+
+func (l *Limiter) evict() {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	rateClients.Set(float64(len(l.buckets)))
+}
+
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if auth.Exempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		release, rejected := l.acquire(clientKey(ctx), info.FullMethod, info.FullMethod)
+		if rejected != nil {
+			return nil, rejected.status()
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if auth.Exempt(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		release, rejected := l.acquire(clientKey(ss.Context()), info.FullMethod, info.FullMethod)
+		if rejected != nil {
+			return rejected.status()
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
+
+/*
+Limits plain HTTP requests like calls of the gRPC methods that serve the same data, so the
+method concurrency limits apply to them too. Requests without methods are only rate limited.
+Rejected requests get 429 with a Retry-After header.
+Must be wrapped in the authentication handler, so that clients are told apart by their credentials.
+*/
+func (l *Limiter) HTTPHandler(methods func(req *http.Request) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		client := clientKey(req.Context())
+		if client == unknownClient {
+			client = "addr:" + host(req.RemoteAddr)
+		}
+
+		release, rejected := l.acquire(client, req.URL.Path, methods(req)...)
+		if rejected != nil {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejected.delay.Seconds()))))
+			http.Error(res, rejected.message, http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next.ServeHTTP(res, req)
+	})
+}
+
+// Reason of a rejected call and the suggested retry delay
+type rejection struct {
+	message string
+	delay   time.Duration
+}
+
+// ResourceExhausted error with the suggested retry delay
+func (r *rejection) status() error {
+	st := status.New(codes.ResourceExhausted, r.message)
+	// Round up to whole milliseconds so the delay is never zero
+	delay := time.Duration(math.Ceil(float64(r.delay)/float64(time.Millisecond))) * time.Millisecond
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+/*
+Checks the client rate limit and the concurrency limits of the methods. Returned function
+must be called when the call is done. Rejections are counted for the methods, or for the name
+when there are none.
+*/
+func (l *Limiter) acquire(client, name string, methods ...string) (func(), *rejection) {
+	labels := methods
+	if len(labels) == 0 {
+		labels = []string{name}
+	}
+
+	if delay, ok := l.allow(client); !ok {
+		for _, label := range labels {
+			rejectedCalls.WithLabelValues(label, "rate").Inc()
+		}
+		l.log.Debug("rate limit exceeded",
+			zap.String("client", client),
+			zap.String("method", name))
+		return nil, &rejection{message: "rate limit exceeded", delay: delay}
+	}
+
+	releases := []func(){}
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, method := range methods {
+		r, ok := l.start(method)
+		if !ok {
+			release()
+			rejectedCalls.WithLabelValues(method, "concurrency").Inc()
+			l.log.Debug("concurrency limit exceeded",
+				zap.String("client", client),
+				zap.String("method", method))
+			return nil, &rejection{message: "too many concurrent calls", delay: concurrencyRetryDelay}
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// Takes a token from the client bucket. Returns how long to wait when the bucket is empty.
+func (l *Limiter) allow(client string) (time.Duration, bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0, true
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.buckets[client] = b
+		rateClients.Set(float64(len(l.buckets)))
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// Rejected calls do not use up tokens
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// Counts the call as in progress unless the method limit is reached
+func (l *Limiter) start(fullMethod string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := l.concurrency[fullMethod]
+	if !ok {
+		limit = l.concurrency[AnyMethod]
+	}
+	if limit == 0 {
+		return func() {}, true
+	}
+
+	if l.inFlight[fullMethod] >= limit {
+		return nil, false
+	}
+	l.inFlight[fullMethod]++
+	callsInFlight.WithLabelValues(fullMethod).Inc()
+
+	return func() {
+		l.mu.Lock()
+		l.inFlight[fullMethod]--
+		l.mu.Unlock()
+		callsInFlight.WithLabelValues(fullMethod).Dec()
+	}, true
+}
+
+// Key of calls that can not be told apart by credentials or address
+const unknownClient = "unknown"
+
+func clientKey(ctx context.Context) string {
+	if principal, ok := auth.FromContext(ctx); ok {
+		return "principal:" + principal.Tenant + "/" + principal.Subject
+	}
+	if addr, ok := gateway.ClientAddr(ctx); ok {
+		return "addr:" + addr
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return "addr:" + host(p.Addr.String())
+	}
+	return unknownClient
+}
+
+// Host part of the address, the address itself when it has no port
+func host(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
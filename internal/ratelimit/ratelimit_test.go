@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+)
+
+const testMethod = "/grpc.sample.TicketService/TicketScores"
+
+// Limiter with a clock that only moves when the test moves it
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(perSecond float64, burst int, concurrency map[string]int) (*Limiter, *testClock) {
+	clock := &testClock{now: time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)}
+	l := New(zap.NewNop(), perSecond, burst, concurrency)
+	l.now = clock.Now
+	return l, clock
+}
+
+func principalContext(subject string) context.Context {
+	return auth.NewContext(context.Background(), &auth.Principal{Subject: subject, Tenant: "default"})
+}
+
+// Makes a unary call through the interceptor, handler runs inside the call
+func call(l *Limiter, ctx context.Context, handler func() error) error {
+	info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+	_, err := l.UnaryServerInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, handler()
+	})
+	return err
+}
+
+func ok() error { return nil }
+
+func TestTokenBucket(t *testing.T) {
+	l, clock := newTestLimiter(1, 2, nil)
+	alice, bob := principalContext("alice"), principalContext("bob")
+
+	for i := 0; i < 2; i++ {
+		if err := call(l, alice, ok); err != nil {
+			t.Fatalf("call %d within the burst failed: %v", i+1, err)
+		}
+	}
+
+	err := call(l, alice, ok)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v after the burst, want ResourceExhausted", err)
+	}
+	var delay time.Duration
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			delay = info.RetryDelay.AsDuration()
+		}
+	}
+	if delay != time.Second {
+		t.Fatalf("got retry delay %v, want 1s", delay)
+	}
+
+	// Buckets are per client
+	if err := call(l, bob, ok); err != nil {
+		t.Fatalf("other client was limited: %v", err)
+	}
+
+	clock.Add(time.Second)
+	if err := call(l, alice, ok); err != nil {
+		t.Fatalf("call after the refill failed: %v", err)
+	}
+	if err := call(l, alice, ok); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted after one refilled token", err)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	l, _ := newTestLimiter(0, 1, nil)
+	for i := 0; i < 100; i++ {
+		if err := call(l, principalContext("alice"), ok); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	l, _ := newTestLimiter(0, 1, map[string]int{testMethod: 1})
+	ctx := principalContext("alice")
+
+	var nested error
+	err := call(l, ctx, func() error {
+		nested = call(l, principalContext("bob"), ok)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code(nested) != codes.ResourceExhausted {
+		t.Fatalf("got %v for a call over the limit, want ResourceExhausted", nested)
+	}
+
+	// Slot is released when the call is done
+	if err := call(l, ctx, ok); err != nil {
+		t.Fatalf("call after the release failed: %v", err)
+	}
+}
+
+func TestEvictsIdleClients(t *testing.T) {
+	l, clock := newTestLimiter(1, 1, nil)
+	if err := call(l, principalContext("alice"), ok); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(idleTimeout / 2)
+	if err := call(l, principalContext("bob"), ok); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(idleTimeout/2 + time.Second)
+	l.evict()
+	if _, ok := l.buckets["principal:default/alice"]; ok || len(l.buckets) != 1 {
+		t.Fatalf("got buckets %v, want only bob", l.buckets)
+	}
+
+	// Evicted client starts with a full bucket
+	if err := call(l, principalContext("alice"), ok); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	l, _ := newTestLimiter(1, 1, map[string]int{testMethod: 1})
+	methods := func(req *http.Request) []string {
+		if req.URL.Path == "/reports" {
+			return nil
+		}
+		return []string{testMethod}
+	}
+
+	var nested *httptest.ResponseRecorder
+	handler := l.HTTPHandler(methods, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("nested") != "" {
+			// Another client while the first request is in progress
+			nested = httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/export/ticket-scores", nil)
+			r.RemoteAddr = "192.0.2.2:1234"
+			l.HTTPHandler(methods, http.NotFoundHandler()).ServeHTTP(nested, r)
+		}
+	}))
+	serve := func(path, subject, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr
+		if subject != "" {
+			req = req.WithContext(principalContext(subject))
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := serve("/export/ticket-scores?nested=1", "alice", "192.0.2.1:1234"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.Code)
+	}
+	if nested.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d over the concurrency limit, want 429", nested.Code)
+	}
+
+	// Rate limit is keyed by principal, so clients behind the same address are apart
+	res := serve("/export/ticket-scores", "alice", "192.0.2.1:1234")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got status %d with Retry-After %q, want 429 with 1", res.Code, res.Header().Get("Retry-After"))
+	}
+	if res := serve("/export/ticket-scores", "bob", "192.0.2.1:1234"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d for another principal, want 200", res.Code)
+	}
+
+	// Without a principal clients are keyed by address, requests without methods are rate limited
+	if res := serve("/reports", "", "192.0.2.3:1234"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.Code)
+	}
+	if res := serve("/reports", "", "192.0.2.3:5678"); res.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d from the same address, want 429", res.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+)
+
+/*
+HTTP handler for stored reports of the caller's tenant.
+
+	/reports lists reports as JSON
+	/reports/{name} serves the report HTML
+*/
+func Handler(logger *zap.Logger, store *Store) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// Reports include the overall score of all the categories
+		if _, restricted := auth.AllowedCategories(req.Context()); restricted {
+			http.Error(res, "reports are not available with category restrictions", http.StatusForbidden)
+			return
+		}
+
+		tenant := auth.Tenant(req.Context())
+		name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/reports"), "/")
+
+		if name == "" {
+			reports, err := store.List(tenant)
+			if err != nil {
+				logger.Error("failed to list reports", zap.Error(err))
+				http.Error(res, "failed to list reports", http.StatusInternalServerError)
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(res).Encode(reports)
+			return
+		}
+
+		path, err := store.Path(tenant, name)
+		if err != nil {
+			http.NotFound(res, req)
+			return
+		}
+		http.ServeFile(res, req, path)
+	})
+}
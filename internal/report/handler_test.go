@@ -0,0 +1,102 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+)
+
+const testPolicy = `
+roles:
+  viewer:
+    methods: ["*"]
+  analyst:
+    methods: ["*"]
+    categories: [Spelling]
+`
+
+func TestHandler(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := newTestGenerator()
+	for _, tenant := range []string{"acme", "other"} {
+		report, err := g.Generate(context.Background(), tenant, testFrom, testTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Save(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Report of the other tenant only
+	report, err := g.Generate(context.Background(), "other", testFrom, testFrom.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(report); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := auth.LoadPolicy(zap.NewNop(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := func(req *http.Request) []string { return []string{"/grpc.sample.TicketService/OveralScore"} }
+	handler := policy.HTTPHandler(methods, Handler(zap.NewNop(), store))
+
+	serve := func(path, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{Subject: "test", Roles: []string{role}, Tenant: "acme"}))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := serve("/reports", "viewer")
+	var reports []Info
+	if err := json.NewDecoder(res.Body).Decode(&reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Name != "report-2019-03-01_2019-03-03.html" {
+		t.Fatalf("got reports %v, want only the tenant's report", reports)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		role string
+		code int
+	}{
+		{name: "own report", path: "/reports/report-2019-03-01_2019-03-03.html", role: "viewer", code: http.StatusOK},
+		{name: "report of other tenant", path: "/reports/report-2019-03-01_2019-03-02.html", role: "viewer", code: http.StatusNotFound},
+		{name: "path outside the tenant", path: "/reports/../other/report-2019-03-01_2019-03-02.html", role: "viewer", code: http.StatusNotFound},
+		{name: "restricted categories", path: "/reports", role: "analyst", code: http.StatusForbidden},
+		{name: "restricted categories report", path: "/reports/report-2019-03-01_2019-03-03.html", role: "analyst", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(tt.path, tt.role)
+			if res.Code != tt.code {
+				t.Fatalf("got status %d, want %d", res.Code, tt.code)
+			}
+			if tt.code == http.StatusOK && !strings.Contains(res.Body.String(), "Tenant acme,") {
+				t.Fatal("served report of another tenant")
+			}
+		})
+	}
+}
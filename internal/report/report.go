@@ -0,0 +1,235 @@
+package report
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// How many of the lowest scoring tickets are listed in the report
+const worstTicketsCount = 10
+
+func NewGenerator(svc pb.TicketServiceServer, categories pb.CategoryServiceServer) *Generator {
+	return &Generator{svc: svc, categories: categories, now: time.Now}
+}
+
+// Generator collects report data by calling the ticket and category service methods
+type Generator struct {
+	svc        pb.TicketServiceServer
+	categories pb.CategoryServiceServer
+	now        func() time.Time
+}
+
+type Report struct {
+	Tenant       string
+	From         time.Time
+	To           time.Time
+	Created      time.Time
+	OverallScore int32
+	PeriodType   string
+	Periods      []string
+	Categories   []CategoryRow
+	WorstTickets []TicketRow
+}
+
+type CategoryRow struct {
+	Name    string
+	Ratings int32
+	Scores  []int32
+	// Score change over the previous period of the same length
+	Change int32
+}
+
+type TicketRow struct {
+	ID     int32
+	Score  int32
+	Scores []int32
+}
+
+/*
+Generates a report of the tenant's data for the given period.
+Period over period changes are calculated against the preceding period of the same length.
+*/
+func (g *Generator) Generate(ctx context.Context, tenant string, from, to time.Time) (*Report, error) {
+	// Service methods read the tenant from the caller principal
+	ctx = auth.NewContext(ctx, &auth.Principal{Subject: "report-generator", Tenant: tenant})
+
+	period := &pb.TimePeriod{
+		From: timestamppb.New(from),
+		To:   timestamppb.New(to),
+	}
+
+	overall, err := g.svc.OveralScore(ctx, period)
+	if err != nil {
+		return nil, errors.Wrap(err, "overall score")
+	}
+
+	categoryScores, err := g.svc.CategoryScores(ctx, period)
+	if err != nil {
+		return nil, errors.Wrap(err, "category scores")
+	}
+
+	previous := &pb.TimePeriod{
+		From: timestamppb.New(from.Add(-to.Sub(from))),
+		To:   timestamppb.New(from),
+	}
+	changes, err := g.svc.PeriodOverPeriod(ctx, &pb.TimePeriods{First: previous, Second: period})
+	if err != nil {
+		return nil, errors.Wrap(err, "period over period")
+	}
+
+	ticketScores, err := g.svc.TicketScores(ctx, period)
+	if err != nil {
+		return nil, errors.Wrap(err, "ticket scores")
+	}
+
+	categories, err := g.categories.ListCategories(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrap(err, "categories")
+	}
+	weights := map[string]float64{}
+	for _, category := range categories.Categories {
+		weights[category.Name] = category.Weight
+	}
+
+	report := &Report{
+		Tenant:       tenant,
+		From:         from,
+		To:           to,
+		Created:      g.now().UTC(),
+		OverallScore: overall.Score,
+		PeriodType:   categoryScores.Period.String(),
+	}
+
+	// Category rows with a score column for every period
+	scores := map[string]map[string]int32{}
+	for _, score := range categoryScores.Scores {
+		if _, ok := scores[score.Period]; !ok {
+			scores[score.Period] = map[string]int32{}
+			report.Periods = append(report.Periods, score.Period)
+		}
+		scores[score.Period][score.Category] = score.Score
+	}
+	sort.Strings(report.Periods)
+
+	diffs := map[string]int32{}
+	for _, change := range changes.Changes {
+		diffs[change.Category] = change.Diff
+	}
+
+	for _, count := range categoryScores.Counts {
+		row := CategoryRow{
+			Name:    count.Name,
+			Ratings: count.Count,
+			Change:  diffs[count.Name],
+		}
+		for _, period := range report.Periods {
+			row.Scores = append(row.Scores, scores[period][count.Name])
+		}
+		report.Categories = append(report.Categories, row)
+	}
+
+	report.WorstTickets = worstTickets(ticketScores, report.Categories, weights)
+	return report, nil
+}
+
+/*
+Returns tickets with the lowest score. Category scores of a ticket are weighted like in the
+overall score, where a category counts with its weight plus one.
+*/
+func worstTickets(in *pb.TicketScoresOut, categories []CategoryRow, weights map[string]float64) []TicketRow {
+	byTicket := map[int32]map[string]int32{}
+	ids := []int32{}
+	for _, score := range in.Scores {
+		if _, ok := byTicket[score.Id]; !ok {
+			byTicket[score.Id] = map[string]int32{}
+			ids = append(ids, score.Id)
+		}
+		byTicket[score.Id][score.Category] = score.Score
+	}
+
+	rows := make([]TicketRow, 0, len(ids))
+	for _, id := range ids {
+		row := TicketRow{ID: id}
+		for _, category := range categories {
+			row.Scores = append(row.Scores, byTicket[id][category.Name])
+		}
+		var weighted, total float64
+		for category, score := range byTicket[id] {
+			weight := weights[category] + 1
+			weighted += float64(score) * weight
+			total += weight
+		}
+		row.Score = int32(math.Round(weighted / total))
+		rows = append(rows, row)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Score == rows[j].Score {
+			return rows[i].ID < rows[j].ID
+		}
+		return rows[i].Score < rows[j].Score
+	})
+	if len(rows) > worstTicketsCount {
+		rows = rows[:worstTicketsCount]
+	}
+	return rows
+}
+
+// Writes the report as a self-contained HTML page
+func (r *Report) Render(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date":     func(t time.Time) string { return t.Format(db.SimpleDateFormat) },
+	"datetime": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Ticket quality report {{date .From}} - {{date .To}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f0f0f0; }
+.score { font-size: 3em; font-weight: bold; }
+.negative { color: #b00; }
+.positive { color: #070; }
+</style>
+</head>
+<body>
+<h1>Ticket quality report</h1>
+<p>Tenant {{.Tenant}}, period {{date .From}} - {{date .To}}, generated {{datetime .Created}}</p>
+
+<h2>Overall score</h2>
+<p class="score">{{.OverallScore}} %</p>
+
+<h2>Categories</h2>
+<table>
+<tr><th>Category</th><th>Ratings</th>{{range .Periods}}<th>{{.}}</th>{{end}}<th>Change</th></tr>
+{{range .Categories}}<tr><td>{{.Name}}</td><td>{{.Ratings}}</td>{{range .Scores}}<td>{{.}} %</td>{{end}}<td class="{{if lt .Change 0}}negative{{else if gt .Change 0}}positive{{end}}">{{.Change}} %</td></tr>
+{{end}}</table>
+<p>Scores by {{.PeriodType}}. Change is compared to the previous period of the same length.</p>
+
+<h2>Worst tickets</h2>
+<table>
+<tr><th>Ticket</th><th>Score</th>{{range .Categories}}<th>{{.Name}}</th>{{end}}</tr>
+{{range .WorstTickets}}<tr><td>{{.ID}}</td><td>{{.Score}} %</td>{{range .Scores}}<td>{{.}} %</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
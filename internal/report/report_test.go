@@ -0,0 +1,168 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Returns fixed scores for every period and records the calls
+type ticketServer struct {
+	pb.UnimplementedTicketServiceServer
+
+	mu      sync.Mutex
+	tenants []string
+	periods []*pb.TimePeriod
+}
+
+func (s *ticketServer) record(ctx context.Context, period *pb.TimePeriod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants = append(s.tenants, auth.Tenant(ctx))
+	s.periods = append(s.periods, period)
+}
+
+func (s *ticketServer) OveralScore(ctx context.Context, in *pb.TimePeriod) (*pb.OveralScoreOut, error) {
+	s.record(ctx, in)
+	return &pb.OveralScoreOut{Score: 63}, nil
+}
+
+func (s *ticketServer) CategoryScores(ctx context.Context, in *pb.TimePeriod) (*pb.CategoryScoresOut, error) {
+	return &pb.CategoryScoresOut{
+		Period: pb.CategoryScoresOut_DAY,
+		Scores: []*pb.PeriodScore{
+			{Category: "Spelling", Period: "2019-03-02", Score: 70},
+			{Category: "Grammar", Period: "2019-03-02", Score: 50},
+			{Category: "Spelling", Period: "2019-03-01", Score: 50},
+			{Category: "Grammar", Period: "2019-03-01", Score: 70},
+		},
+		Counts: []*pb.CategoryCount{{Id: 1, Name: "Spelling", Count: 4}, {Id: 2, Name: "Grammar", Count: 4}},
+	}, nil
+}
+
+func (s *ticketServer) PeriodOverPeriod(ctx context.Context, in *pb.TimePeriods) (*pb.PeriodOverPeriodOut, error) {
+	return &pb.PeriodOverPeriodOut{Changes: []*pb.CategoryDiff{
+		{Id: 1, Category: "Spelling", Diff: -12},
+		{Id: 2, Category: "Grammar", Diff: 3},
+	}}, nil
+}
+
+/*
+Spelling weighs three times as much as Grammar. Ticket 2 has the lower plain average,
+ticket 1 the lower weighted score.
+*/
+func (s *ticketServer) TicketScores(ctx context.Context, in *pb.TimePeriod) (*pb.TicketScoresOut, error) {
+	return &pb.TicketScoresOut{Scores: []*pb.TicketScore{
+		{Id: 2, Category: "Spelling", Score: 80},
+		{Id: 2, Category: "Grammar", Score: 20},
+		{Id: 1, Category: "Spelling", Score: 40},
+		{Id: 1, Category: "Grammar", Score: 100},
+		{Id: 3, Category: "Spelling", Score: 90},
+	}}, nil
+}
+
+type categoryServer struct {
+	pb.UnimplementedCategoryServiceServer
+}
+
+func (s *categoryServer) ListCategories(ctx context.Context, in *emptypb.Empty) (*pb.Categories, error) {
+	return &pb.Categories{Categories: []*pb.Category{
+		{Id: 1, Name: "Spelling", Weight: 2},
+		{Id: 2, Name: "Grammar", Weight: 0},
+	}}, nil
+}
+
+var (
+	testFrom    = time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	testTo      = time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC)
+	testCreated = time.Date(2019, 3, 3, 6, 0, 0, 0, time.UTC)
+)
+
+func newTestGenerator() (*Generator, *ticketServer) {
+	svc := &ticketServer{}
+	g := NewGenerator(svc, &categoryServer{})
+	g.now = func() time.Time { return testCreated }
+	return g, svc
+}
+
+func TestGenerate(t *testing.T) {
+	g, svc := newTestGenerator()
+	report, err := g.Generate(context.Background(), "acme", testFrom, testTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.tenants[0] != "acme" {
+		t.Fatalf("got service called for tenant %q, want acme", svc.tenants[0])
+	}
+	if !report.Created.Equal(testCreated) || report.OverallScore != 63 || report.PeriodType != "DAY" {
+		t.Fatalf("got report %+v", report)
+	}
+	if want := []string{"2019-03-01", "2019-03-02"}; !reflect.DeepEqual(report.Periods, want) {
+		t.Fatalf("got periods %v, want %v", report.Periods, want)
+	}
+	wantCategories := []CategoryRow{
+		{Name: "Spelling", Ratings: 4, Scores: []int32{50, 70}, Change: -12},
+		{Name: "Grammar", Ratings: 4, Scores: []int32{70, 50}, Change: 3},
+	}
+	if !reflect.DeepEqual(report.Categories, wantCategories) {
+		t.Fatalf("got categories %+v, want %+v", report.Categories, wantCategories)
+	}
+
+	// Scores are weighted by category weight plus one like the overall score
+	wantTickets := []TicketRow{
+		{ID: 1, Score: 55, Scores: []int32{40, 100}},
+		{ID: 2, Score: 65, Scores: []int32{80, 20}},
+		{ID: 3, Score: 90, Scores: []int32{90, 0}},
+	}
+	if !reflect.DeepEqual(report.WorstTickets, wantTickets) {
+		t.Fatalf("got worst tickets %+v, want %+v", report.WorstTickets, wantTickets)
+	}
+}
+
+func TestWorstTicketsLimit(t *testing.T) {
+	in := &pb.TicketScoresOut{}
+	for id := int32(1); id <= worstTicketsCount+5; id++ {
+		in.Scores = append(in.Scores, &pb.TicketScore{Id: id, Category: "Spelling", Score: 100 - id})
+	}
+	rows := worstTickets(in, []CategoryRow{{Name: "Spelling"}}, map[string]float64{"Spelling": 1})
+	if len(rows) != worstTicketsCount || rows[0].ID != worstTicketsCount+5 || rows[0].Score != 100-worstTicketsCount-5 {
+		t.Fatalf("got rows %+v", rows)
+	}
+}
+
+func TestRender(t *testing.T) {
+	g, _ := newTestGenerator()
+	report, err := g.Generate(context.Background(), "acme", testFrom, testTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := report.Render(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		"<title>Ticket quality report 2019-03-01 - 2019-03-03</title>",
+		"Tenant acme, period 2019-03-01 - 2019-03-03, generated 2019-03-03T06:00:00Z",
+		`<p class="score">63 %</p>`,
+		"<th>2019-03-01</th><th>2019-03-02</th>",
+		`<tr><td>Spelling</td><td>4</td><td>50 %</td><td>70 %</td><td class="negative">-12 %</td></tr>`,
+		`<td class="positive">3 %</td>`,
+		"<tr><td>1</td><td>55 %</td><td>40 %</td><td>100 %</td></tr>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+}
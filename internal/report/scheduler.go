@@ -0,0 +1,81 @@
+package report
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+func NewScheduler(logger *zap.Logger, svcDB db.ServiceDB, generator *Generator, store *Store, window time.Duration) *Scheduler {
+	return &Scheduler{
+		log:       logger,
+		db:        svcDB,
+		generator: generator,
+		store:     store,
+		window:    window,
+		now:       time.Now,
+	}
+}
+
+/*
+Scheduler generates a report covering the last window for every tenant on every run.
+Window end is truncated to the start of the UTC day so reports always cover whole days.
+*/
+type Scheduler struct {
+	log       *zap.Logger
+	db        db.ServiceDB
+	generator *Generator
+	store     *Store
+	window    time.Duration
+	now       func() time.Time
+}
+
+// Generates a report every interval until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.Generate(ctx, s.now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) Generate(ctx context.Context, now time.Time) {
+	to := now.UTC().Truncate(24 * time.Hour)
+	from := to.Add(-s.window)
+
+	tenants, err := s.db.Tenants()
+	if err != nil {
+		s.log.Error("failed to list tenants for reports", zap.Error(err))
+		return
+	}
+
+	for _, tenant := range tenants {
+		report, err := s.generator.Generate(ctx, tenant, from, to)
+		if err != nil {
+			s.log.Error("report generation failed",
+				zap.String("tenant", tenant),
+				zap.Error(err))
+			continue
+		}
+
+		name, err := s.store.Save(report)
+		if err != nil {
+			s.log.Error("failed to store report",
+				zap.String("tenant", tenant),
+				zap.Error(err))
+			continue
+		}
+		s.log.Info("report generated",
+			zap.String("tenant", tenant),
+			zap.String("name", name))
+	}
+}
@@ -0,0 +1,52 @@
+package report
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+)
+
+// Returns the tenants set in the test
+type tenantDB struct {
+	*memory.MemoryDB
+	tenants []string
+}
+
+func (d *tenantDB) Tenants() ([]string, error) {
+	return d.tenants, nil
+}
+
+func TestSchedulerGeneratesWholeDays(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, svc := newTestGenerator()
+	svcDB := &tenantDB{MemoryDB: memory.New(), tenants: []string{"acme", "default"}}
+	s := NewScheduler(zap.NewNop(), svcDB, g, store, 7*24*time.Hour)
+	s.now = func() time.Time { return time.Date(2019, 3, 8, 15, 30, 0, 0, time.FixedZone("EET", 2*60*60)) }
+
+	// Run generates before waiting for the first tick
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx, time.Hour)
+
+	for _, tenant := range svcDB.tenants {
+		reports, err := store.List(tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != 1 || reports[0].Name != "report-2019-03-01_2019-03-08.html" {
+			t.Fatalf("got reports %v for %s, want the week before the UTC day", reports, tenant)
+		}
+	}
+
+	from, to := svc.periods[0].From.AsTime(), svc.periods[0].To.AsTime()
+	if !from.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2019, 3, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got period %v - %v", from, to)
+	}
+}
@@ -0,0 +1,120 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db"
+)
+
+var (
+	ErrNotFound = errors.New("report not found")
+
+	reportName = regexp.MustCompile(`^report-\d{4}-\d{2}-\d{2}_\d{4}-\d{2}-\d{2}\.html$`)
+)
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create report directory")
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Store keeps rendered reports as HTML files in a subdirectory per tenant
+type Store struct {
+	dir string
+}
+
+type Info struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// Renders and writes the report. Report for the same tenant and period gets overwritten.
+func (store *Store) Save(report *Report) (string, error) {
+	dir, err := store.tenantDir(report.Tenant)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create report directory")
+	}
+
+	var buf bytes.Buffer
+	if err := report.Render(&buf); err != nil {
+		return "", errors.Wrap(err, "failed to render report")
+	}
+
+	name := fmt.Sprintf("report-%s_%s.html",
+		report.From.Format(db.SimpleDateFormat), report.To.Format(db.SimpleDateFormat))
+
+	tmp := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write report")
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return "", errors.Wrap(err, "failed to write report")
+	}
+	return name, nil
+}
+
+// Lists stored reports of the tenant, newest first
+func (store *Store) List(tenant string) ([]Info, error) {
+	dir, err := store.tenantDir(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []Info{}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return reports, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read report directory")
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !reportName.MatchString(file.Name()) {
+			continue
+		}
+		reports = append(reports, Info{
+			Name:    file.Name(),
+			Size:    file.Size(),
+			Created: file.ModTime().UTC(),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name > reports[j].Name })
+	return reports, nil
+}
+
+// Returns path to a stored report of the tenant. Only names returned by List are accepted.
+func (store *Store) Path(tenant, name string) (string, error) {
+	dir, err := store.tenantDir(tenant)
+	if err != nil || !reportName.MatchString(name) {
+		return "", ErrNotFound
+	}
+
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+func (store *Store) tenantDir(tenant string) (string, error) {
+	if err := auth.ValidateTenant(tenant); err != nil {
+		return "", err
+	}
+	return filepath.Join(store.dir, tenant), nil
+}
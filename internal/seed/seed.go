@@ -0,0 +1,249 @@
+package seed
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const (
+	// Average rating of categories without one
+	DefaultMean = 4.0
+	// Weekend days get this share of the working day ticket volume
+	weekendVolume = 0.4
+	// Chance that a ticket is rated in a category
+	ratedShare = 0.8
+	// Reviewers and reviewees are picked from the same agents
+	agents = 50
+)
+
+// Rating categories of the sample database
+var DefaultCategories = []Category{
+	{Name: "Spelling", Weight: 1, Mean: 4.3},
+	{Name: "Grammar", Weight: 0.7, Mean: 3.9},
+	{Name: "GDPR", Weight: 1.2, Mean: 4.5},
+	{Name: "Randomness", Weight: 0, Mean: 2.5},
+}
+
+var subjects = []string{
+	"Password reset", "Refund request", "Delivery delayed", "Account locked",
+	"Invoice question", "Bug report", "Feature request", "Cancel subscription",
+}
+
+// Rating category with the average of its generated ratings
+type Category struct {
+	Name   string
+	Weight float64
+	Mean   float64
+}
+
+// Shifts the average rating of the category, or all categories with *, within the period
+type Anomaly struct {
+	Category string
+	From     time.Time
+	To       time.Time
+	Shift    float64
+}
+
+type Config struct {
+	Tenant string
+	// Tickets are created from the start of From until the start of To
+	From          time.Time
+	To            time.Time
+	TicketsPerDay float64
+	Categories    []Category
+	// Standard deviation of the ratings around the category average
+	Spread float64
+	// Yearly swing of the average ratings in rating points, highest in spring and lowest in autumn
+	Seasonality float64
+	Anomalies   []Anomaly
+	// The same seed generates the same tickets and ratings
+	Seed int64
+}
+
+type Summary struct {
+	Tickets int
+	Ratings int
+}
+
+/*
+Generate creates the categories and adds tickets with ratings for every day of the period
+through the database write methods, so the daily rollup is kept up to date.
+Ticket counts per day follow a Poisson distribution around TicketsPerDay with fewer tickets
+on weekends and most tickets created during office hours. Ratings are normally distributed
+around the category average with seasonality and anomalies added.
+*/
+func Generate(logger *zap.Logger, svcDB db.ServiceDB, config Config) (Summary, error) {
+	summary := Summary{}
+	if !config.To.After(config.From) {
+		return summary, errors.New("period end must be after the start")
+	}
+	if config.TicketsPerDay <= 0 {
+		return summary, errors.New("tickets per day must be positive")
+	}
+	if len(config.Categories) == 0 {
+		return summary, errors.New("no rating categories")
+	}
+
+	ids := make([]int32, len(config.Categories))
+	for i, category := range config.Categories {
+		saved, err := svcDB.SaveCategory(config.Tenant, &pb.Category{Name: category.Name, Weight: category.Weight})
+		if err != nil {
+			return summary, errors.Wrapf(err, "failed to save category %q", category.Name)
+		}
+		ids[i] = saved.Id
+	}
+
+	rng := rand.New(rand.NewSource(config.Seed))
+	monthTickets := 0
+	for day := config.From.UTC().Truncate(24 * time.Hour); day.Before(config.To); day = day.AddDate(0, 0, 1) {
+		volume := config.TicketsPerDay
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			volume *= weekendVolume
+		}
+
+		for n := poisson(rng, volume); n > 0; n-- {
+			ticket := newTicket(rng, config, ids, day)
+			if _, err := svcDB.AddTicket(config.Tenant, ticket); err != nil {
+				return summary, errors.Wrapf(err, "failed to add ticket for %s", day.Format(db.SimpleDateFormat))
+			}
+			monthTickets++
+			summary.Tickets++
+			summary.Ratings += len(ticket.Ratings)
+		}
+
+		if next := day.AddDate(0, 0, 1); next.Month() != day.Month() || !next.Before(config.To) {
+			logger.Info("seeded month",
+				zap.String("month", day.Format("2006-01")),
+				zap.Int("tickets", monthTickets))
+			monthTickets = 0
+		}
+	}
+	return summary, nil
+}
+
+func newTicket(rng *rand.Rand, config Config, ids []int32, day time.Time) *pb.Ticket {
+	// Office hours peak in the early afternoon UTC
+	hours := math.Min(math.Max(13+rng.NormFloat64()*3.5, 0), 23.99)
+	createdAt := day.Add(time.Duration(hours * float64(time.Hour))).Truncate(time.Second)
+
+	ticket := &pb.Ticket{
+		Subject:   subjects[rng.Intn(len(subjects))],
+		CreatedAt: timestamppb.New(createdAt),
+	}
+	for i, category := range config.Categories {
+		// Every ticket has at least one rating
+		if rng.Float64() >= ratedShare && !(i == len(config.Categories)-1 && len(ticket.Ratings) == 0) {
+			continue
+		}
+		mean := category.Mean + seasonal(config.Seasonality, day) + shift(config.Anomalies, category.Name, day)
+		rating := math.Round(mean + rng.NormFloat64()*config.Spread)
+		ticket.Ratings = append(ticket.Ratings, &pb.Rating{
+			CategoryId: ids[i],
+			Rating:     int32(math.Min(math.Max(rating, 0), db.MaxRating)),
+			ReviewerId: int32(rng.Intn(agents) + 1),
+			RevieweeId: int32(rng.Intn(agents) + 1),
+			// Ratings are given within two days of the ticket
+			CreatedAt: timestamppb.New(createdAt.Add(time.Duration(rng.Intn(48*60)) * time.Minute)),
+		})
+	}
+	return ticket
+}
+
+func seasonal(amplitude float64, day time.Time) float64 {
+	return amplitude * math.Sin(2*math.Pi*float64(day.YearDay()-1)/365)
+}
+
+func shift(anomalies []Anomaly, category string, day time.Time) float64 {
+	total := 0.0
+	for _, a := range anomalies {
+		if (a.Category == "*" || a.Category == category) && !day.Before(a.From) && day.Before(a.To) {
+			total += a.Shift
+		}
+	}
+	return total
+}
+
+// Knuth's algorithm is slow for large means where the normal approximation is close enough
+func poisson(rng *rand.Rand, mean float64) int {
+	if mean > 30 {
+		return int(math.Max(math.Round(mean+rng.NormFloat64()*math.Sqrt(mean)), 0))
+	}
+	limit, p, n := math.Exp(-mean), 1.0, 0
+	for {
+		p *= rng.Float64()
+		if p <= limit {
+			return n
+		}
+		n++
+	}
+}
+
+// Parses comma separated list of NAME=WEIGHT or NAME=WEIGHT:MEAN categories
+func ParseCategories(spec string) ([]Category, error) {
+	categories := []Category{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("invalid category %q, expected name=weight or name=weight:mean", item)
+		}
+		values := strings.SplitN(parts[1], ":", 2)
+		weight, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid category %q, weight must be a non-negative number", item)
+		}
+		mean := DefaultMean
+		if len(values) == 2 {
+			mean, err = strconv.ParseFloat(strings.TrimSpace(values[1]), 64)
+			if err != nil || mean < 0 || mean > db.MaxRating {
+				return nil, errors.Errorf("invalid category %q, mean must be between 0 and %d", item, db.MaxRating)
+			}
+		}
+		categories = append(categories, Category{Name: strings.TrimSpace(parts[0]), Weight: weight, Mean: mean})
+	}
+	return categories, nil
+}
+
+// Parses comma separated list of CATEGORY:FROM:TO:SHIFT anomalies with YYYY-MM-DD dates
+func ParseAnomalies(spec string) ([]Anomaly, error) {
+	anomalies := []Anomaly{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, errors.Errorf("invalid anomaly %q, expected category:from:to:shift", item)
+		}
+		from, err := time.Parse(db.SimpleDateFormat, parts[1])
+		if err != nil {
+			return nil, errors.Errorf("invalid anomaly %q, from must be YYYY-MM-DD", item)
+		}
+		to, err := time.Parse(db.SimpleDateFormat, parts[2])
+		if err != nil || !to.After(from) {
+			return nil, errors.Errorf("invalid anomaly %q, to must be YYYY-MM-DD after from", item)
+		}
+		shift, err := strconv.ParseFloat(parts[3], 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid anomaly %q, shift must be a number", item)
+		}
+		anomalies = append(anomalies, Anomaly{Category: parts[0], From: from, To: to, Shift: shift})
+	}
+	return anomalies, nil
+}
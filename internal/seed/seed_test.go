@@ -0,0 +1,185 @@
+package seed
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+)
+
+var (
+	testFrom = time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	testTo   = time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func testConfig() Config {
+	return Config{
+		Tenant:        "acme",
+		From:          testFrom,
+		To:            testTo,
+		TicketsPerDay: 20,
+		Categories:    DefaultCategories,
+		Spread:        1,
+		Seasonality:   0.3,
+		Seed:          42,
+	}
+}
+
+// Seeds an empty memory database and returns all its tickets and ratings
+func generate(t *testing.T, config Config) (Summary, *memory.MemoryDB, []db.TicketRow, []db.RatingRow) {
+	t.Helper()
+	svcDB := memory.New()
+	summary, err := Generate(zap.NewNop(), svcDB, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets, err := svcDB.ExportTickets(0, math.MaxInt32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratings, err := svcDB.ExportRatings(0, math.MaxInt32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary, svcDB, tickets, ratings
+}
+
+func TestGenerate(t *testing.T) {
+	summary, svcDB, tickets, ratings := generate(t, testConfig())
+
+	if summary.Tickets != len(tickets) || summary.Ratings != len(ratings) {
+		t.Fatalf("got summary %+v, database has %d tickets and %d ratings", summary, len(tickets), len(ratings))
+	}
+	// 21 working days and 10 weekend days with 40% of the volume
+	if expected := 20 * (21 + 10*weekendVolume); math.Abs(float64(len(tickets))-expected) > expected*0.1 {
+		t.Fatalf("got %d tickets, want about %.0f", len(tickets), expected)
+	}
+
+	categories, err := svcDB.Categories("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != len(DefaultCategories) {
+		t.Fatalf("got %d categories, want %d", len(categories), len(DefaultCategories))
+	}
+
+	created := map[int32]time.Time{}
+	for _, ticket := range tickets {
+		if ticket.Tenant != "acme" || ticket.CreatedAt.Before(testFrom) || !ticket.CreatedAt.Before(testTo) {
+			t.Fatalf("got ticket %+v outside the tenant or period", ticket)
+		}
+		created[ticket.ID] = ticket.CreatedAt
+	}
+
+	rated := map[int32]bool{}
+	for _, rating := range ratings {
+		if !rating.Rating.Valid || rating.Rating.Int32 < 0 || rating.Rating.Int32 > db.MaxRating {
+			t.Fatalf("got rating %+v out of bounds", rating)
+		}
+		if rating.ReviewerID < 1 || rating.ReviewerID > agents || rating.RevieweeID < 1 || rating.RevieweeID > agents {
+			t.Fatalf("got rating %+v with unknown agents", rating)
+		}
+		ticketCreated, ok := created[rating.TicketID]
+		if !ok {
+			t.Fatalf("got rating %+v of unknown ticket", rating)
+		}
+		if delay := rating.CreatedAt.Sub(ticketCreated); delay < 0 || delay >= 48*time.Hour {
+			t.Fatalf("got rating %v after the ticket, want within two days", delay)
+		}
+		rated[rating.TicketID] = true
+	}
+	if len(rated) != len(tickets) {
+		t.Fatalf("got %d of %d tickets rated, want all", len(rated), len(tickets))
+	}
+}
+
+func TestGenerateIsRepeatable(t *testing.T) {
+	summary, _, tickets, ratings := generate(t, testConfig())
+	again, _, ticketsAgain, ratingsAgain := generate(t, testConfig())
+	if summary != again || !reflect.DeepEqual(tickets, ticketsAgain) || !reflect.DeepEqual(ratings, ratingsAgain) {
+		t.Fatal("same seed generated different data")
+	}
+
+	config := testConfig()
+	config.Seed = 43
+	_, _, _, other := generate(t, config)
+	if reflect.DeepEqual(ratings, other) {
+		t.Fatal("different seeds generated the same ratings")
+	}
+}
+
+func TestGenerateAnomaly(t *testing.T) {
+	config := testConfig()
+	config.Seasonality = 0
+	config.Anomalies = []Anomaly{{Category: "*", From: testFrom.AddDate(0, 0, 14), To: testTo, Shift: -2}}
+	_, svcDB, _, _ := generate(t, config)
+
+	before, err := svcDB.OveralScore("acme", testFrom, testFrom.AddDate(0, 0, 14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	during, err := svcDB.OveralScore("acme", testFrom.AddDate(0, 0, 16), testTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two rating points are 40% of the score
+	if before-during < 30 {
+		t.Fatalf("got overall score %d before and %d during the anomaly", before, during)
+	}
+}
+
+func TestGenerateRejectsInvalidConfig(t *testing.T) {
+	tests := map[string]func(c *Config){
+		"empty period":         func(c *Config) { c.To = c.From },
+		"no tickets":           func(c *Config) { c.TicketsPerDay = 0 },
+		"no rating categories": func(c *Config) { c.Categories = nil },
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig()
+			change(&config)
+			if _, err := Generate(zap.NewNop(), memory.New(), config); err == nil {
+				t.Fatal("generation succeeded")
+			}
+		})
+	}
+}
+
+func TestParseCategories(t *testing.T) {
+	got, err := ParseCategories("Spelling=1:4.5, Tone=0.5,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Category{{Name: "Spelling", Weight: 1, Mean: 4.5}, {Name: "Tone", Weight: 0.5, Mean: DefaultMean}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"Spelling", "=1", "Spelling=-1", "Spelling=1:6"} {
+		if _, err := ParseCategories(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
+
+func TestParseAnomalies(t *testing.T) {
+	got, err := ParseAnomalies("*:2019-03-01:2019-03-08:-1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Anomaly{{Category: "*", From: testFrom, To: testFrom.AddDate(0, 0, 7), Shift: -1.5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"Spelling:2019-03-01:2019-03-08", "Spelling:2019-03-08:2019-03-01:1", "Spelling:2019-03-01:2019-03-08:low"} {
+		if _, err := ParseAnomalies(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"math"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Manages rating categories of the caller's tenant
+type categoryServer struct {
+	log *zap.Logger
+	db  db.ServiceDB
+}
+
+func (s *categoryServer) ListCategories(ctx context.Context, in *emptypb.Empty) (*pb.Categories, error) {
+	categories, err := s.db.Categories(auth.Tenant(ctx))
+	if err != nil {
+		s.log.Error("DB error", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to read categories from the database")
+	}
+	return &pb.Categories{Categories: categories}, nil
+}
+
+func (s *categoryServer) SaveCategory(ctx context.Context, in *pb.Category) (*pb.Category, error) {
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "category name is required")
+	}
+	if in.Weight < 0 || math.IsNaN(in.Weight) || math.IsInf(in.Weight, 0) {
+		return nil, status.Error(codes.InvalidArgument, "category weight must be a non-negative number")
+	}
+
+	tenant := auth.Tenant(ctx)
+	s.log.Info("save category",
+		zap.String("tenant", tenant),
+		zap.String("name", in.Name),
+		zap.Float64("weight", in.Weight))
+
+	category, err := s.db.SaveCategory(tenant, in)
+	if err != nil {
+		s.log.Error("DB error", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to save category to the database")
+	}
+	return category, nil
+}
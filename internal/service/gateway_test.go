@@ -0,0 +1,154 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/gateway"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+const testKeys = `{"keys": [
+  {"key": "default-key", "subject": "dashboard"},
+  {"key": "acme-key", "subject": "acme-dashboard", "tenant": "acme"}
+]}`
+
+// REST gateway in front of the gRPC server of the demo fixture, calls are authenticated with API keys
+func newTestGateway(t *testing.T) *gateway.Gateway {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := ioutil.WriteFile(path, []byte(testKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(zap.NewNop(), keys, nil)
+
+	gw, err := gateway.New(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Register("TicketService"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestService(t)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(authenticator.UnaryServerInterceptor()))
+	pb.RegisterTicketServiceServer(grpcServer, &s)
+	go func() { _ = grpcServer.Serve(gw.Listener()) }()
+	t.Cleanup(func() {
+		gw.Close()
+		grpcServer.Stop()
+	})
+	return gw
+}
+
+func TestGateway(t *testing.T) {
+	gw := newTestGateway(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		key    string
+		code   int
+		// Expected JSON response
+		want string
+	}{
+		{
+			name: "post", method: http.MethodPost, path: "/v1/TicketService/OveralScore",
+			body: `{"from": "2019-03-04T00:00:00Z", "to": "2019-03-11T00:00:00Z"}`, key: "default-key",
+			code: http.StatusOK, want: `{"score": 69}`,
+		},
+		{
+			name: "get with query parameters", method: http.MethodGet,
+			path: "/v1/TicketService/OveralScore?from=2019-03-04T00:00:00Z&to=2019-03-11T00:00:00Z", key: "default-key",
+			code: http.StatusOK, want: `{"score": 69}`,
+		},
+		{
+			name: "nested query parameters", method: http.MethodGet,
+			path: "/v1/TicketService/PeriodOverPeriod?first.from=2019-03-04T00:00:00Z&first.to=2019-03-11T00:00:00Z" +
+				"&second.from=2019-03-11T00:00:00Z&second.to=2019-03-18T00:00:00Z", key: "acme-key",
+			code: http.StatusOK, want: `{"changes": []}`,
+		},
+		{
+			name: "tenant of the API key", method: http.MethodPost, path: "/v1/TicketService/OveralScore",
+			body: `{"from": "2019-03-04T00:00:00Z", "to": "2019-03-11T00:00:00Z"}`, key: "acme-key",
+			code: http.StatusOK, want: `{"score": 20}`,
+		},
+		{
+			name: "invalid argument", method: http.MethodPost, path: "/v1/TicketService/OveralScore",
+			body: `{"from": "2019-03-11T00:00:00Z", "to": "2019-03-04T00:00:00Z"}`, key: "default-key",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "malformed body", method: http.MethodPost, path: "/v1/TicketService/OveralScore",
+			body: `{"from": 1}`, key: "default-key", code: http.StatusBadRequest,
+		},
+		{
+			name: "missing credentials", method: http.MethodPost, path: "/v1/TicketService/OveralScore",
+			body: `{"from": "2019-03-04T00:00:00Z", "to": "2019-03-11T00:00:00Z"}`, code: http.StatusUnauthorized,
+		},
+		{name: "unknown method", method: http.MethodPost, path: "/v1/TicketService/Unknown", key: "default-key", code: http.StatusNotFound},
+		{name: "http method not allowed", method: http.MethodDelete, path: "/v1/TicketService/OveralScore", key: "default-key", code: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.key != "" {
+				req.Header.Set("X-Api-Key", tt.key)
+			}
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("got status %d (%s), want %d", res.Code, res.Body.String(), tt.code)
+			}
+			if tt.want == "" {
+				return
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %s, want %s", res.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayErrorBody(t *testing.T) {
+	gw := newTestGateway(t)
+	req := httptest.NewRequest(http.MethodPost, "/v1/TicketService/TicketScores", strings.NewReader(`{}`))
+	res := httptest.NewRecorder()
+	gw.ServeHTTP(res, req)
+
+	var body struct {
+		Code  int    `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusUnauthorized || body.Code != int(codes.Unauthenticated) || body.Error != "Unauthenticated" {
+		t.Fatalf("got status %d with %s", res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+/*
+Wraps the HTTP handler so gRPC-Web requests get passed to the gRPC server.
+Cross-origin requests are only allowed from the listed origins, "*" allows any origin.
+*/
+func grpcWebHandler(grpcServer *grpc.Server, origins []string, next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	wrapped := grpcweb.WrapServer(grpcServer,
+		grpcweb.WithOriginFunc(func(origin string) bool {
+			return allowed["*"] || allowed[origin]
+		}),
+		grpcweb.WithAllowedRequestHeaders([]string{"Authorization", "X-Api-Key"}),
+	)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if wrapped.IsGrpcWebRequest(req) || wrapped.IsAcceptableGrpcCorsRequest(req) {
+			wrapped.ServeHTTP(res, req)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
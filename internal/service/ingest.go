@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+// Adds tickets and ratings of the caller's tenant
+type ingestServer struct {
+	log *zap.Logger
+	db  db.ServiceDB
+}
+
+func (s *ingestServer) AddTicket(ctx context.Context, in *pb.Ticket) (*pb.Ticket, error) {
+	if in.CreatedAt == nil || in.CreatedAt.CheckValid() != nil {
+		return nil, status.Error(codes.InvalidArgument, "valid ticket created_at is required")
+	}
+	if err := validateRatings(in.Ratings); err != nil {
+		return nil, err
+	}
+
+	tenant := auth.Tenant(ctx)
+	s.log.Info("add ticket",
+		zap.String("tenant", tenant),
+		zap.Int("ratings", len(in.Ratings)))
+
+	id, err := s.db.AddTicket(tenant, in)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	out := &pb.Ticket{
+		Id:        id,
+		Subject:   in.Subject,
+		CreatedAt: in.CreatedAt,
+		Ratings:   in.Ratings,
+	}
+	return out, nil
+}
+
+func (s *ingestServer) AddRatings(ctx context.Context, in *pb.TicketRatings) (*emptypb.Empty, error) {
+	if len(in.Ratings) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one rating is required")
+	}
+	if err := validateRatings(in.Ratings); err != nil {
+		return nil, err
+	}
+
+	tenant := auth.Tenant(ctx)
+	s.log.Info("add ratings",
+		zap.String("tenant", tenant),
+		zap.Int32("ticket", in.TicketId),
+		zap.Int("ratings", len(in.Ratings)))
+
+	if err := s.db.AddRatings(tenant, in.TicketId, in.Ratings); err != nil {
+		return nil, s.statusError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *ingestServer) statusError(err error) error {
+	if errors.Cause(err) == db.ErrNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	s.log.Error("DB error", zap.Error(err))
+	return status.Error(codes.Internal, "failed to write to the database")
+}
+
+func validateRatings(ratings []*pb.Rating) error {
+	for _, rating := range ratings {
+		if rating.Rating < 0 || rating.Rating > db.MaxRating {
+			return status.Errorf(codes.InvalidArgument, "rating must be between 0 and %d", db.MaxRating)
+		}
+		if rating.CreatedAt != nil && rating.CreatedAt.CheckValid() != nil {
+			return status.Error(codes.InvalidArgument, "invalid rating created_at")
+		}
+	}
+	return nil
+}
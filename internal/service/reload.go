@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_sample_config_reloads_total",
+		Help: "Configuration reloads by result, success or failure.",
+	}, []string{"result"})
+	configReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_sample_config_last_reload_success_timestamp_seconds",
+		Help: "Time of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloads, configReloadTime)
+	configReloads.WithLabelValues("success")
+	configReloads.WithLabelValues("failure")
+}
+
+/*
+Calls reload on SIGHUP. The function must leave the running configuration in place when it fails.
+Without it SIGHUP stops the process as usual.
+*/
+func WithReload(reload func() error) Option {
+	return func(s *Service) {
+		s.reload = reload
+	}
+}
+
+/*
+Reloads the configuration on signals from hup until the context is cancelled.
+The caller subscribes hup to SIGHUP before starting this, so an early signal does not stop the process.
+*/
+func (s *Service) watchReload(ctx context.Context, hup chan os.Signal) {
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := s.reload(); err != nil {
+				configReloads.WithLabelValues("failure").Inc()
+				s.log.Error("configuration reload failed, keeping the running configuration", zap.Error(err))
+				continue
+			}
+			configReloads.WithLabelValues("success").Inc()
+			configReloadTime.Set(float64(time.Now().Unix()))
+			s.log.Info("configuration reloaded")
+		}
+	}
+}
@@ -11,32 +11,155 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tanelmae/grpc-sample/internal/alert"
+	"github.com/tanelmae/grpc-sample/internal/auth"
 	"github.com/tanelmae/grpc-sample/internal/db"
+	"github.com/tanelmae/grpc-sample/internal/export"
+	"github.com/tanelmae/grpc-sample/internal/gateway"
+	"github.com/tanelmae/grpc-sample/internal/health"
+	"github.com/tanelmae/grpc-sample/internal/ratelimit"
+	"github.com/tanelmae/grpc-sample/internal/report"
+	"github.com/tanelmae/grpc-sample/internal/tlsconfig"
 	"github.com/tanelmae/grpc-sample/pb"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
+// How long to wait for in-flight requests on shutdown
+const shutdownTimeout = 10 * time.Second
+
 /*
 	Configure with options
 */
 
-func New(logger *zap.Logger, db db.ServiceDB) Service {
-	return Service{
-		log: logger,
-		db:  db,
+type Option func(*Service)
+
+// Serve AlertService and evaluate the alert rules on the given interval
+func WithAlerts(store *alert.Store, evaluator *alert.Evaluator, interval time.Duration) Option {
+	return func(s *Service) {
+		s.alertStore = store
+		s.alertEvaluator = evaluator
+		s.alertInterval = interval
+	}
+}
+
+// Generate reports on the given interval and serve them from /reports
+func WithReports(store *report.Store, interval, window time.Duration) Option {
+	return func(s *Service) {
+		s.reportStore = store
+		s.reportInterval = interval
+		s.reportWindow = window
+	}
+}
+
+// Allowed origins for cross-origin gRPC-Web requests
+func WithCORSOrigins(origins []string) Option {
+	return func(s *Service) {
+		s.corsOrigins = origins
+	}
+}
+
+// How often the database is probed for health checks
+func WithHealthInterval(interval time.Duration) Option {
+	return func(s *Service) {
+		s.healthInterval = interval
+	}
+}
+
+// How long to keep serving with readiness failing before stopping on shutdown
+func WithShutdownDelay(delay time.Duration) Option {
+	return func(s *Service) {
+		s.shutdownDelay = delay
+	}
+}
+
+// Adds a check that must pass for the service to be ready
+func WithReadinessCheck(name string, check func(ctx context.Context) error) Option {
+	return func(s *Service) {
+		s.readinessChecks = append(s.readinessChecks, namedCheck{name: name, check: check})
+	}
+}
+
+// Serve gRPC and HTTP with TLS. Certificates are checked for changes on the given interval.
+func WithTLS(reloader *tlsconfig.Reloader, reloadInterval time.Duration) Option {
+	return func(s *Service) {
+		s.tls = reloader
+		s.tlsReloadInterval = reloadInterval
+	}
+}
+
+// Require authentication for all the calls except health checks
+func WithAuth(authenticator *auth.Authenticator) Option {
+	return func(s *Service) {
+		s.auth = authenticator
+	}
+}
+
+// Limit call rate per client and concurrent calls per method
+func WithRateLimits(limiter *ratelimit.Limiter) Option {
+	return func(s *Service) {
+		s.limiter = limiter
+	}
+}
+
+// Authorize calls with the role policy. Requires authentication.
+func WithPolicy(policy *auth.Policy) Option {
+	return func(s *Service) {
+		s.policy = policy
 	}
 }
 
+func New(logger *zap.Logger, db db.ServiceDB, opts ...Option) Service {
+	s := Service{
+		log:            logger,
+		db:             db,
+		healthInterval: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
 type Service struct {
 	log *zap.Logger
 	db  db.ServiceDB
+
+	healthInterval  time.Duration
+	shutdownDelay   time.Duration
+	readinessChecks []namedCheck
+
+	alertStore     *alert.Store
+	alertEvaluator *alert.Evaluator
+	alertInterval  time.Duration
+
+	reportStore    *report.Store
+	reportInterval time.Duration
+	reportWindow   time.Duration
+
+	corsOrigins []string
+
+	tls               *tlsconfig.Reloader
+	tlsReloadInterval time.Duration
+
+	auth    *auth.Authenticator
+	policy  *auth.Policy
+	limiter *ratelimit.Limiter
+
+	reload func() error
+}
+
+type namedCheck struct {
+	name  string
+	check func(ctx context.Context) error
 }
 
 func (s *Service) Run(grpcAddress, httpAddress, apiDocsPath string) {
@@ -44,15 +167,87 @@ func (s *Service) Run(grpcAddress, httpAddress, apiDocsPath string) {
 	if err != nil {
 		s.log.Info("Failed to listen", zap.String("address", grpcAddress))
 	}
-	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gw, err := gateway.New(s.log)
+	if err != nil {
+		s.log.Fatal("failed to create REST gateway", zap.Error(err))
+	}
+	defer gw.Close()
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{grpc_prometheus.UnaryServerInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{grpc_prometheus.StreamServerInterceptor}
+	if s.auth != nil {
+		unaryInterceptors = append(unaryInterceptors, s.auth.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, s.auth.StreamServerInterceptor())
+	}
+	if s.policy != nil {
+		unaryInterceptors = append(unaryInterceptors, s.policy.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, s.policy.StreamServerInterceptor())
+	}
+	// Limits are applied after authentication so clients can be told apart by their credentials,
+	// and after authorization so denied calls do not use up tokens and concurrency slots
+	if s.limiter != nil {
+		unaryInterceptors = append(unaryInterceptors, s.limiter.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, s.limiter.StreamServerInterceptor())
+		go s.limiter.Run(ctx)
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	if s.tls != nil {
+		serverOpts = append(serverOpts,
+			grpc.Creds(gw.ServerCredentials(credentials.NewTLS(s.tls.ServerConfig()))))
+		go s.tls.Run(ctx, s.tlsReloadInterval)
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
 	pb.RegisterTicketServiceServer(grpcServer, s)
+	pb.RegisterCategoryServiceServer(grpcServer, &categoryServer{log: s.log, db: s.db})
+	pb.RegisterIngestServiceServer(grpcServer, &ingestServer{log: s.log, db: s.db})
 	grpc_prometheus.Register(grpcServer)
 
-	grpc_health_v1.RegisterHealthServer(grpcServer, s)
+	checker := health.NewChecker(s.log, s.db)
+	for _, c := range s.readinessChecks {
+		checker.AddReadinessCheck(c.name, c.check)
+	}
+	grpc_health_v1.RegisterHealthServer(grpcServer, checker.Server())
+	go checker.Run(ctx, s.healthInterval)
+
+	if s.alertStore != nil {
+		pb.RegisterAlertServiceServer(grpcServer, alert.NewServer(s.log, s.alertStore))
+		go s.alertEvaluator.Run(ctx, s.alertInterval)
+	}
+
+	for _, name := range []protoreflect.Name{"TicketService", "CategoryService", "IngestService"} {
+		if err := gw.Register(name); err != nil {
+			s.log.Fatal("failed to register REST gateway", zap.Error(err))
+		}
+	}
+	go func() {
+		if err := grpcServer.Serve(gw.Listener()); err != nil {
+			s.log.Fatal("grpc gateway listener failure",
+				zap.Error(err))
+		}
+	}()
+
+	if s.reportStore != nil {
+		scheduler := report.NewScheduler(s.log, s.db, report.NewGenerator(s, &categoryServer{log: s.log, db: s.db}), s.reportStore, s.reportWindow)
+		go scheduler.Run(ctx, s.reportInterval)
+	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	defer close(stop)
+	if s.reload != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go s.watchReload(ctx, hup)
+	}
 
 	go func() {
 		if err := grpcServer.Serve(listener); err != nil {
@@ -63,6 +258,8 @@ func (s *Service) Run(grpcAddress, httpAddress, apiDocsPath string) {
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
 	mux.Handle("/docs", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		http.ServeFile(res, req, filepath.Join(apiDocsPath, "/index.html"))
 	}))
@@ -70,10 +267,29 @@ func (s *Service) Run(grpcAddress, httpAddress, apiDocsPath string) {
 		http.ServeFile(res, req, filepath.Join(apiDocsPath, "/service.proto"))
 	}))
 
-	srv := http.Server{Addr: httpAddress, Handler: mux}
+	mux.Handle("/export/", s.authenticated(s.authorized(export.Methods,
+		s.limited(export.Methods, export.Handler(s.log, s.db)))))
+	mux.Handle(gateway.Prefix, gw)
+
+	if s.reportStore != nil {
+		// Reports are read from files, so they only count towards the rate limit
+		reports := s.authenticated(s.authorized(reportMethods,
+			s.limited(noMethods, report.Handler(s.log, s.reportStore))))
+		mux.Handle("/reports", reports)
+		mux.Handle("/reports/", reports)
+	}
+
+	srv := http.Server{Addr: httpAddress, Handler: grpcWebHandler(grpcServer, s.corsOrigins, mux)}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.tls != nil {
+			srv.TLSConfig = s.tls.ServerConfig()
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			s.log.Fatal("HTTP server failure",
 				zap.Error(err))
 		}
@@ -83,34 +299,47 @@ func (s *Service) Run(grpcAddress, httpAddress, apiDocsPath string) {
 	sig := <-stop
 	s.log.Info("signal received", zap.String("signal", sig.String()))
 
+	checker.Shutdown()
+	if s.shutdownDelay > 0 {
+		// Give load balancers time to notice the service is not ready
+		s.log.Info("draining", zap.Duration("delay", s.shutdownDelay))
+		time.Sleep(s.shutdownDelay)
+	}
+	cancel()
+
+	// Health Watch streams stay open until the client goes away
+	// so graceful stop is limited in time
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.log.Warn("graceful stop timed out")
+		grpcServer.Stop()
+	}
 	_ = srv.Shutdown(context.Background())
-	grpcServer.GracefulStop()
 	s.db.Close()
 
 	s.log.Info("service stopped")
 }
 
-func (s *Service) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
-	// Should check something meaningful here
-	return &grpc_health_v1.HealthCheckResponse{
-		Status: grpc_health_v1.HealthCheckResponse_SERVING,
-	}, nil
-}
-
-func (s *Service) Watch(req *grpc_health_v1.HealthCheckRequest, ws grpc_health_v1.Health_WatchServer) error {
-	// Should check something meaningful here
-	return nil
-}
-
 /*
 Aggregated category scores over a period of time
 E.g. what have the daily ticket scores been for a past week or what were the scores between 1st and 31st of January.
 For periods longer than one month weekly aggregates should be returned instead of daily values.
 */
 func (s *Service) CategoryScores(ctx context.Context, in *pb.TimePeriod) (*pb.CategoryScoresOut, error) {
+	if err := validatePeriod(in); err != nil {
+		return nil, err
+	}
+	tenant := auth.Tenant(ctx)
 	startTime := in.From.AsTime()
 	endTime := in.To.AsTime()
 	s.log.Info("category scores",
+		zap.String("tenant", tenant),
 		zap.String("from", startTime.String()),
 		zap.String("to", endTime.String()),
 	)
@@ -120,21 +349,21 @@ func (s *Service) CategoryScores(ctx context.Context, in *pb.TimePeriod) (*pb.Ca
 
 	if endTime.After(startTime.AddDate(0, 1, 0)) {
 		out.Period = pb.CategoryScoresOut_WEEK
-		out.Scores, err = s.db.WeeklyScores(startTime, endTime)
+		out.Scores, err = s.db.WeeklyScores(tenant, startTime, endTime)
 		if err != nil {
 			s.log.Error("DB error", zap.Error(err))
 			return nil, status.Error(codes.Internal, "failed to read weekly scores from DB")
 		}
 	} else {
 		out.Period = pb.CategoryScoresOut_DAY
-		out.Scores, err = s.db.DailyScores(startTime, endTime)
+		out.Scores, err = s.db.DailyScores(tenant, startTime, endTime)
 		if err != nil {
 			s.log.Error("DB error", zap.Error(err))
 			return nil, status.Error(codes.Internal, "failed to read daily scores from DB")
 		}
 	}
 
-	out.Counts, err = s.db.RatingCounts(startTime, endTime)
+	out.Counts, err = s.db.RatingCounts(tenant, startTime, endTime)
 	if err != nil {
 		s.log.Error("DB error", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to read rating counts from DB")
@@ -147,9 +376,14 @@ Scores by ticket. Aggregate scores for categories within defined period by ticke
 E.g. what aggregate category scores tickets have within defined rating time range have.
 */
 func (s *Service) TicketScores(ctx context.Context, in *pb.TimePeriod) (*pb.TicketScoresOut, error) {
+	if err := validatePeriod(in); err != nil {
+		return nil, err
+	}
+	tenant := auth.Tenant(ctx)
 	from := in.From.AsTime()
 	to := in.To.AsTime()
 	s.log.Info("ticket scores",
+		zap.String("tenant", tenant),
 		zap.String("from", from.Format(time.RFC3339)),
 		zap.String("to", to.Format(time.RFC3339)),
 	)
@@ -157,13 +391,13 @@ func (s *Service) TicketScores(ctx context.Context, in *pb.TimePeriod) (*pb.Tick
 	var err error
 	out := pb.TicketScoresOut{}
 
-	out.Scores, err = s.db.TicketScores(from, to)
+	out.Scores, err = s.db.TicketScores(tenant, from, to)
 	if err != nil {
 		s.log.Error("DB error", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to read tickets score from the database")
 	}
 
-	out.Categories, err = s.db.RatingCategories()
+	out.Categories, err = s.db.RatingCategories(tenant)
 	if err != nil {
 		s.log.Error("DB error", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to read categories from the database")
@@ -177,9 +411,14 @@ Overal quality score. What is the overall aggregate score for a period.
 E.g. the overall score over past week has been 96%.
 */
 func (s *Service) OveralScore(ctx context.Context, in *pb.TimePeriod) (*pb.OveralScoreOut, error) {
+	if err := validatePeriod(in); err != nil {
+		return nil, err
+	}
+	tenant := auth.Tenant(ctx)
 	from := in.From.AsTime()
 	to := in.To.AsTime()
 	s.log.Info("overal scores",
+		zap.String("tenant", tenant),
 		zap.String("from", from.Format(time.RFC3339)),
 		zap.String("to", to.Format(time.RFC3339)),
 	)
@@ -187,7 +426,7 @@ func (s *Service) OveralScore(ctx context.Context, in *pb.TimePeriod) (*pb.Overa
 	var err error
 	out := pb.OveralScoreOut{}
 
-	out.Score, err = s.db.OveralScore(from, to)
+	out.Score, err = s.db.OveralScore(tenant, from, to)
 	if err != nil {
 		s.log.Error("DB error", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to read overall score from the database")
@@ -201,12 +440,20 @@ Period over Period score change. What has been the change from selected period o
 E.g. current week vs. previous week or December vs. January change in percentages.
 */
 func (s *Service) PeriodOverPeriod(ctx context.Context, in *pb.TimePeriods) (*pb.PeriodOverPeriodOut, error) {
+	if err := validatePeriod(in.First); err != nil {
+		return nil, err
+	}
+	if err := validatePeriod(in.Second); err != nil {
+		return nil, err
+	}
+	tenant := auth.Tenant(ctx)
 	firstFrom := in.First.From.AsTime()
 	firstTo := in.First.To.AsTime()
 	secondFrom := in.Second.From.AsTime()
 	secondTo := in.Second.To.AsTime()
 
 	s.log.Info("period over period",
+		zap.String("tenant", tenant),
 		zap.String("first period",
 			fmt.Sprintf("%s - %s", firstFrom.Format(time.RFC3339), firstTo.Format(time.RFC3339))),
 		zap.String("second period",
@@ -215,7 +462,7 @@ func (s *Service) PeriodOverPeriod(ctx context.Context, in *pb.TimePeriods) (*pb
 
 	var err error
 	out := pb.PeriodOverPeriodOut{}
-	out.Changes, err = s.db.PeriodOverPeriod(
+	out.Changes, err = s.db.PeriodOverPeriod(tenant,
 		firstFrom, firstTo, secondFrom, secondTo,
 	)
 
@@ -226,3 +473,57 @@ func (s *Service) PeriodOverPeriod(ctx context.Context, in *pb.TimePeriods) (*pb
 
 	return &out, nil
 }
+
+// Requires authentication for HTTP endpoints that serve tenant data
+func (s *Service) authenticated(handler http.Handler) http.Handler {
+	if s.auth == nil {
+		return handler
+	}
+	return s.auth.HTTPHandler(handler)
+}
+
+// Applies the authorization policy of the gRPC methods serving the same data
+func (s *Service) authorized(methods func(req *http.Request) []string, handler http.Handler) http.Handler {
+	if s.policy == nil {
+		return handler
+	}
+	return s.policy.HTTPHandler(methods, handler)
+}
+
+// Applies the rate limit and the concurrency limits of the gRPC methods serving the same data
+func (s *Service) limited(methods func(req *http.Request) []string, handler http.Handler) http.Handler {
+	if s.limiter == nil {
+		return handler
+	}
+	return s.limiter.HTTPHandler(methods, handler)
+}
+
+func noMethods(req *http.Request) []string {
+	return nil
+}
+
+// Reports are built from the results of all of these
+func reportMethods(req *http.Request) []string {
+	return []string{
+		"/grpc.sample.TicketService/CategoryScores",
+		"/grpc.sample.TicketService/TicketScores",
+		"/grpc.sample.TicketService/OveralScore",
+		"/grpc.sample.TicketService/PeriodOverPeriod",
+	}
+}
+
+func validatePeriod(in *pb.TimePeriod) error {
+	if in == nil || in.From == nil || in.To == nil {
+		return status.Error(codes.InvalidArgument, "time period with from and to is required")
+	}
+	if err := in.From.CheckValid(); err != nil {
+		return status.Error(codes.InvalidArgument, "invalid from time")
+	}
+	if err := in.To.CheckValid(); err != nil {
+		return status.Error(codes.InvalidArgument, "invalid to time")
+	}
+	if in.From.AsTime().After(in.To.AsTime()) {
+		return status.Error(codes.InvalidArgument, "from time must not be after to time")
+	}
+	return nil
+}
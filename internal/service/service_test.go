@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/tanelmae/grpc-sample/internal/auth"
+	"github.com/tanelmae/grpc-sample/internal/db/memory"
+	"github.com/tanelmae/grpc-sample/pb"
+)
+
+/*
+Demo fixture of the default tenant has Spelling (weight 1) and Grammar (weight 0.5) ratings
+of tickets 1 and 2 in the week of 2019-03-04 and of ticket 3 in the week after it.
+Tenant acme has one Spelling rating of ticket 10 in the first week.
+*/
+func newTestService(t *testing.T) Service {
+	t.Helper()
+	svcDB, err := memory.NewFromFile("testdata/demo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(zap.NewNop(), svcDB)
+}
+
+func period(from, to string) *pb.TimePeriod {
+	parse := func(date string) *timestamppb.Timestamp {
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			panic(err)
+		}
+		return timestamppb.New(t)
+	}
+	return &pb.TimePeriod{From: parse(from), To: parse(to)}
+}
+
+func tenantContext(tenant string) context.Context {
+	return auth.NewContext(context.Background(), &auth.Principal{Subject: "test", Tenant: tenant})
+}
+
+func checkResponse(t *testing.T, got, want proto.Message, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCategoryScores(t *testing.T) {
+	s := newTestService(t)
+
+	t.Run("daily", func(t *testing.T) {
+		got, err := s.CategoryScores(context.Background(), period("2019-03-04", "2019-03-11"))
+		checkResponse(t, got, &pb.CategoryScoresOut{
+			Period: pb.CategoryScoresOut_DAY,
+			Scores: []*pb.PeriodScore{
+				{Id: "1", Category: "Spelling", Period: "2019-03-04", Score: 100},
+				{Id: "2", Category: "Grammar", Period: "2019-03-04", Score: 60},
+				{Id: "1", Category: "Spelling", Period: "2019-03-05", Score: 80},
+				{Id: "2", Category: "Grammar", Period: "2019-03-05", Score: 20},
+			},
+			Counts: []*pb.CategoryCount{
+				{Id: 1, Name: "Spelling", Count: 2},
+				{Id: 2, Name: "Grammar", Count: 2},
+			},
+		}, err)
+	})
+
+	t.Run("weekly over a month", func(t *testing.T) {
+		got, err := s.CategoryScores(context.Background(), period("2019-03-01", "2019-04-15"))
+		checkResponse(t, got, &pb.CategoryScoresOut{
+			Period: pb.CategoryScoresOut_WEEK,
+			Scores: []*pb.PeriodScore{
+				{Id: "1", Category: "Spelling", Period: "2019 09", Score: 90},
+				{Id: "2", Category: "Grammar", Period: "2019 09", Score: 40},
+				{Id: "1", Category: "Spelling", Period: "2019 10", Score: 40},
+				{Id: "2", Category: "Grammar", Period: "2019 10", Score: 100},
+			},
+			Counts: []*pb.CategoryCount{
+				{Id: 1, Name: "Spelling", Count: 3},
+				{Id: 2, Name: "Grammar", Count: 3},
+			},
+		}, err)
+	})
+}
+
+func TestTicketScores(t *testing.T) {
+	s := newTestService(t)
+
+	got, err := s.TicketScores(context.Background(), period("2019-03-04", "2019-03-11"))
+	checkResponse(t, got, &pb.TicketScoresOut{
+		Scores: []*pb.TicketScore{
+			{Id: 1, Category: "Spelling", Score: 100},
+			{Id: 1, Category: "Grammar", Score: 60},
+			{Id: 2, Category: "Spelling", Score: 80},
+			{Id: 2, Category: "Grammar", Score: 20},
+		},
+		Categories: []string{"Spelling", "Grammar"},
+	}, err)
+}
+
+func TestOveralScore(t *testing.T) {
+	s := newTestService(t)
+
+	// Spelling 18 of 20 and Grammar 6 of 15 with the weights
+	got, err := s.OveralScore(context.Background(), period("2019-03-04", "2019-03-11"))
+	checkResponse(t, got, &pb.OveralScoreOut{Score: 69}, err)
+
+	got, err = s.OveralScore(context.Background(), period("2020-01-01", "2020-02-01"))
+	checkResponse(t, got, &pb.OveralScoreOut{Score: 0}, err)
+}
+
+func TestPeriodOverPeriod(t *testing.T) {
+	s := newTestService(t)
+
+	got, err := s.PeriodOverPeriod(context.Background(), &pb.TimePeriods{
+		First:  period("2019-03-04", "2019-03-11"),
+		Second: period("2019-03-11", "2019-03-18"),
+	})
+	checkResponse(t, got, &pb.PeriodOverPeriodOut{
+		Changes: []*pb.CategoryDiff{
+			{Id: 1, Category: "Spelling", Diff: -50},
+			{Id: 2, Category: "Grammar", Diff: 60},
+		},
+	}, err)
+}
+
+func TestTenantScoping(t *testing.T) {
+	s := newTestService(t)
+	week := period("2019-03-04", "2019-03-11")
+
+	tickets, err := s.TicketScores(tenantContext("acme"), week)
+	checkResponse(t, tickets, &pb.TicketScoresOut{
+		Scores:     []*pb.TicketScore{{Id: 10, Category: "Spelling", Score: 20}},
+		Categories: []string{"Spelling"},
+	}, err)
+
+	overall, err := s.OveralScore(tenantContext("acme"), week)
+	checkResponse(t, overall, &pb.OveralScoreOut{Score: 20}, err)
+
+	// Principal without a tenant reads the default tenant
+	overall, err = s.OveralScore(tenantContext(""), week)
+	checkResponse(t, overall, &pb.OveralScoreOut{Score: 69}, err)
+
+	scores, err := s.CategoryScores(tenantContext("other"), week)
+	checkResponse(t, scores, &pb.CategoryScoresOut{Period: pb.CategoryScoresOut_DAY}, err)
+
+	changes, err := s.PeriodOverPeriod(tenantContext("acme"), &pb.TimePeriods{
+		First:  week,
+		Second: period("2019-03-11", "2019-03-18"),
+	})
+	checkResponse(t, changes, &pb.PeriodOverPeriodOut{}, err)
+}
+
+func TestPeriodValidation(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	week := period("2019-03-04", "2019-03-11")
+
+	invalid := map[string]*pb.TimePeriod{
+		"no period":     nil,
+		"no to":         {From: week.From},
+		"from after to": period("2019-03-11", "2019-03-04"),
+		"invalid from":  {From: &timestamppb.Timestamp{Nanos: -1}, To: week.To},
+		"invalid to":    {From: week.From, To: &timestamppb.Timestamp{Seconds: -1e12}},
+	}
+	for name, in := range invalid {
+		t.Run(name, func(t *testing.T) {
+			calls := map[string]func() error{
+				"CategoryScores": func() error { _, err := s.CategoryScores(ctx, in); return err },
+				"TicketScores":   func() error { _, err := s.TicketScores(ctx, in); return err },
+				"OveralScore":    func() error { _, err := s.OveralScore(ctx, in); return err },
+				"PeriodOverPeriod first": func() error {
+					_, err := s.PeriodOverPeriod(ctx, &pb.TimePeriods{First: in, Second: week})
+					return err
+				},
+				"PeriodOverPeriod second": func() error {
+					_, err := s.PeriodOverPeriod(ctx, &pb.TimePeriods{First: week, Second: in})
+					return err
+				},
+			}
+			for method, call := range calls {
+				if code := status.Code(call()); code != codes.InvalidArgument {
+					t.Errorf("%s returned %v, want InvalidArgument", method, code)
+				}
+			}
+		})
+	}
+
+	// Empty period is valid
+	if _, err := s.OveralScore(ctx, period("2019-03-04", "2019-03-04")); err != nil {
+		t.Fatalf("empty period failed: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// Signs the certificate with the parent, self-signed when parent is nil
+func newKeyPair(t *testing.T, name string, parent *keyPair, template x509.Certificate) *keyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer := &keyPair{cert: &template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &keyPair{cert: cert, key: key}
+}
+
+func newCA(t *testing.T, name string) *keyPair {
+	return newKeyPair(t, name, nil, x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+}
+
+func newServerCert(t *testing.T, name string, ca *keyPair) *keyPair {
+	return newKeyPair(t, name, ca, x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func newClientCert(t *testing.T, name string, ca *keyPair) *keyPair {
+	return newKeyPair(t, name, ca, x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// Writes the certificate and key PEM files into dir, returns their paths
+func (kp *keyPair) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".crt")
+	writePEM(t, certFile, "CERTIFICATE", kp.cert.Raw)
+
+	der, err := x509.MarshalECPrivateKey(kp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Moves the modification time forward so that the change is seen on file systems with coarse times
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TLS server accepting connections with the reloader config, writes a byte after the handshake
+func serve(t *testing.T, r *Reloader) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					_, _ = conn.Write([]byte{1})
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Connects with the client config and returns the common name of the served certificate
+func connect(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// TLS 1.3 clients learn that their certificate was rejected on the first read
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestServesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newServerCert(t, "server", ca).write(t, dir, "server")
+
+	r, err := NewReloader(zap.NewNop(), certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	config, err := ClientConfig(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := connect(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "server" {
+		t.Fatalf("got certificate %q, want server", name)
+	}
+}
+
+func TestLoadFailures(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	certFile, keyFile := newServerCert(t, "server", ca).write(t, dir, "server")
+	_, otherKeyFile := newServerCert(t, "other", ca).write(t, dir, "other")
+	notPEM := filepath.Join(dir, "empty.crt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][3]string{
+		"missing certificate": {filepath.Join(dir, "missing.crt"), keyFile, ""},
+		"mismatched key":      {certFile, otherKeyFile, ""},
+		"invalid client CA":   {certFile, keyFile, notPEM},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewReloader(zap.NewNop(), files[0], files[1], files[2]); err == nil {
+				t.Fatal("loading succeeded")
+			}
+		})
+	}
+}
+
+func TestRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newServerCert(t, "server", ca).write(t, dir, "server")
+	clientCert, clientKey := newClientCert(t, "client", ca).write(t, dir, "client")
+	otherCert, otherKey := newClientCert(t, "other", newCA(t, "other-ca")).write(t, dir, "other")
+
+	r, err := NewReloader(zap.NewNop(), certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+
+	tests := []struct {
+		name      string
+		cert, key string
+		ok        bool
+	}{
+		{name: "signed by the client CA", cert: clientCert, key: clientKey, ok: true},
+		{name: "no certificate"},
+		{name: "signed by another CA", cert: otherCert, key: otherKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ClientConfig(caFile, tt.cert, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = connect(addr, config)
+			if tt.ok && err != nil {
+				t.Fatalf("connection failed: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("connection succeeded")
+			}
+		})
+	}
+}
+
+func TestReloadsRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newServerCert(t, "first", ca).write(t, dir, "server")
+
+	r, err := NewReloader(zap.NewNop(), certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, r)
+	config, err := ClientConfig(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, 10*time.Millisecond)
+
+	waitFor := func(want string) {
+		t.Helper()
+		var name string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if name, err = connect(addr, config); err == nil && name == want {
+				return
+			}
+		}
+		t.Fatalf("got certificate %q (%v), want %q", name, err, want)
+	}
+	waitFor("first")
+
+	newServerCert(t, "second", ca).write(t, dir, "server")
+	touch(t, certFile, keyFile)
+	waitFor("second")
+
+	// Broken files are not loaded and the previous certificate is kept
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, certFile)
+	time.Sleep(50 * time.Millisecond)
+	waitFor("second")
+}
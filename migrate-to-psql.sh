@@ -4,22 +4,9 @@ set -e
 PSQL_HOST=${1:-localhost}
 PSQL_DB=${2:-grpc_sample}
 PSQL_USER=${3:-service}
+PSQL_PASSWORD=${4:-$PGPASSWORD}
 
-echo "load database
-     from sqlite://database.db
-     into postgresql:///grpc_sample
-
- with include drop, create tables, create indexes, reset sequences
-  set work_mem to '16MB', maintenance_work_mem to '512 MB';
-  -- EXCLUDING TABLE NAMES MATCHING 'rating_categories'
-  " > loader.conf
-
-pgloader loader.conf
-
-# Fix rating_categories issue cause by decimal value in the integer column
-echo "ALTER TABLE rating_categories ALTER COLUMN weight TYPE NUMERIC;
-INSERT INTO rating_categories(id,name,weight)
-VALUES('1','Spelling','1'),('2','Grammar','0.7'),('3','GDPR','1.2'),('4','Randomness','0')
-ON CONFLICT (id)
-DO NOTHING;" > fix.sql
-psql -h ${PSQL_HOST}  -d ${PSQL_DB} -U ${PSQL_USER} -f fix.sql
+# Creates the schema, copies the data of database.db and verifies the copy.
+# Safe to run again when interrupted, copying continues where it stopped.
+go run ./cmd/server -db-file=database.db \
+	migrate-data "postgres://${PSQL_USER}:${PSQL_PASSWORD}@${PSQL_HOST}:5432/${PSQL_DB}?sslmode=disable"